@@ -0,0 +1,304 @@
+package libcore
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+type ConnectionInfo struct {
+	Id          int64
+	Uid         int32
+	Network     string
+	Source      string
+	Destination string
+	// Tag is the outbound picked by the v2ray router when the connection was dispatched.
+	Tag string
+
+	Uplink   int64
+	Downlink int64
+
+	StartedAt int64
+	// FirstByteMs is the time from the session start to the first byte sent back, 0 until then.
+	FirstByteMs int64
+	// Dropped is the number of datagrams a UDP session dropped over the write-back high-water mark.
+	Dropped int64
+}
+
+type ConnectionListener interface {
+	OnConnection(info *ConnectionInfo)
+}
+
+type connInfo struct {
+	uplink    uint64
+	downlink  uint64
+	firstByte int64
+	dropped   uint64
+
+	id          int64
+	uid         uint16
+	network     string
+	source      v2rayNet.Destination
+	destination v2rayNet.Destination
+	startedAt   int64
+	start       time.Time
+	closer      io.Closer
+	outbound    *outboundTag
+}
+
+func (c *connInfo) export() *ConnectionInfo {
+	return &ConnectionInfo{
+		Id:          c.id,
+		Uid:         int32(c.uid),
+		Network:     c.network,
+		Source:      c.source.NetAddr(),
+		Destination: c.destination.NetAddr(),
+		Tag:         c.outbound.get(),
+		Uplink:      int64(atomic.LoadUint64(&c.uplink)),
+		Downlink:    int64(atomic.LoadUint64(&c.downlink)),
+		StartedAt:   c.startedAt,
+		FirstByteMs: atomic.LoadInt64(&c.firstByte),
+		Dropped:     int64(atomic.LoadUint64(&c.dropped)),
+	}
+}
+
+// connTable is the registry of active TCP connections and UDP sessions, indexed by uid.
+type connTable struct {
+	access   sync.RWMutex
+	lastId   int64
+	conns    map[int64]*connInfo
+	uidConns map[uint16]map[int64]*connInfo
+
+	tcp              watermark
+	udp              watermark
+	tcpTotal         int32
+	udpTotal         int32
+	resourceListener ResourceListener
+
+	destLimit int32
+	destConns map[string]int32
+
+	duplicatePolicy int32
+	tuples          map[string]*connInfo
+	// closed is set by closeAll, after which add refuses sessions.
+	closed bool
+}
+
+// What happens when the stack delivers a connection whose 5-tuple is already active.
+const (
+	DuplicateAllow int32 = iota
+	DuplicateReject
+	DuplicateReset
+)
+
+func (c *connInfo) tupleKey() string {
+	return c.network + "/" + c.source.NetAddr() + "/" + c.destination.NetAddr()
+}
+
+func (c *connInfo) destKey() string {
+	return c.network + "/" + c.destination.NetAddr()
+}
+
+// add registers the session, or returns false if the tunnel is closing, its destination is at the
+// concurrency limit or it duplicates an active TCP connection under DuplicateReject.
+func (t *connTable) add(c *connInfo) bool {
+	t.access.Lock()
+
+	if t.conns == nil {
+		t.conns = map[int64]*connInfo{}
+		t.uidConns = map[uint16]map[int64]*connInfo{}
+		t.destConns = map[string]int32{}
+		t.tuples = map[string]*connInfo{}
+	}
+	if t.closed {
+		t.access.Unlock()
+		return false
+	}
+	destKey := c.destKey()
+	if t.destLimit > 0 && t.destConns[destKey] >= t.destLimit {
+		t.access.Unlock()
+		return false
+	}
+	var reset io.Closer
+	if c.network == "tcp" && t.duplicatePolicy != DuplicateAllow {
+		if old := t.tuples[c.tupleKey()]; old != nil {
+			if t.duplicatePolicy == DuplicateReject {
+				t.access.Unlock()
+				return false
+			}
+			reset = old.closer
+		}
+		t.tuples[c.tupleKey()] = c
+	}
+	t.destConns[destKey]++
+	t.lastId++
+	c.id = t.lastId
+	t.conns[c.id] = c
+	uidConns := t.uidConns[c.uid]
+	if uidConns == nil {
+		uidConns = map[int64]*connInfo{}
+		t.uidConns[c.uid] = uidConns
+	}
+	uidConns[c.id] = c
+	if c.network == "udp" {
+		t.udpTotal++
+	} else {
+		t.tcpTotal++
+	}
+	notify := t.count(c.network, 1)
+	t.access.Unlock()
+
+	if reset != nil {
+		closeIgnore(reset)
+	}
+	if notify != nil {
+		notify()
+	}
+	return true
+}
+
+func (t *connTable) remove(c *connInfo) {
+	t.access.Lock()
+	if t.tuples[c.tupleKey()] == c {
+		delete(t.tuples, c.tupleKey())
+	}
+	destKey := c.destKey()
+	t.destConns[destKey]--
+	if t.destConns[destKey] <= 0 {
+		delete(t.destConns, destKey)
+	}
+	delete(t.conns, c.id)
+	if uidConns := t.uidConns[c.uid]; uidConns != nil {
+		delete(uidConns, c.id)
+		if len(uidConns) == 0 {
+			delete(t.uidConns, c.uid)
+		}
+	}
+	notify := t.count(c.network, -1)
+	t.access.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+}
+
+func (t *connTable) list(uid uint16, all bool) []*ConnectionInfo {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	conns := t.conns
+	if !all {
+		conns = t.uidConns[uid]
+	}
+	infos := make([]*ConnectionInfo, 0, len(conns))
+	for _, c := range conns {
+		infos = append(infos, c.export())
+	}
+	return infos
+}
+
+func (t *connTable) closersByTag(tag string) []io.Closer {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	var closers []io.Closer
+	for _, c := range t.conns {
+		if c.outbound.get() == tag {
+			closers = append(closers, c.closer)
+		}
+	}
+	return closers
+}
+
+func (t *connTable) udpSessions() int32 {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	return t.udp.count
+}
+
+// SetPerDestConnLimit caps the concurrent connections, and separately UDP sessions, to the same
+// destination address and port across all apps. Sessions over the cap are rejected and 0 disables it.
+func (t *Tun2ray) SetPerDestConnLimit(limit int32) {
+	t.connections.access.Lock()
+	defer t.connections.access.Unlock()
+
+	t.connections.destLimit = limit
+}
+
+// SetDuplicatePolicy sets what happens when a TCP connection arrives for a 5-tuple that is
+// already active: allow both (the default), reject the new one or reset the old one.
+func (t *Tun2ray) SetDuplicatePolicy(policy int32) {
+	t.connections.access.Lock()
+	defer t.connections.access.Unlock()
+
+	t.connections.duplicatePolicy = policy
+}
+
+// SetConnectionIdBase makes connection ids start at base, e.g. the LastConnectionId of the previous
+// instance plus one, so ids stay unique across instances. Ids start at 1 by default.
+func (t *Tun2ray) SetConnectionIdBase(base int64) {
+	t.connections.access.Lock()
+	defer t.connections.access.Unlock()
+
+	t.connections.lastId = base - 1
+}
+
+// LastConnectionId returns the id given to the latest connection or session.
+func (t *Tun2ray) LastConnectionId() int64 {
+	t.connections.access.RLock()
+	defer t.connections.access.RUnlock()
+
+	return t.connections.lastId
+}
+
+// SessionCounts holds the active and cumulative TCP connections and UDP sessions.
+type SessionCounts struct {
+	TcpActive int32
+	UdpActive int32
+	TcpTotal  int32
+	UdpTotal  int32
+}
+
+// SessionCounts returns the active and cumulative session counts in one call.
+func (t *Tun2ray) SessionCounts() *SessionCounts {
+	t.connections.access.RLock()
+	defer t.connections.access.RUnlock()
+
+	return &SessionCounts{
+		TcpActive: t.connections.tcp.count,
+		UdpActive: t.connections.udp.count,
+		TcpTotal:  t.connections.tcpTotal,
+		UdpTotal:  t.connections.udpTotal,
+	}
+}
+
+func (t *Tun2ray) ListConnections(listener ConnectionListener) error {
+	for _, info := range t.connections.list(0, true) {
+		listener.OnConnection(info)
+	}
+	return nil
+}
+
+func (t *Tun2ray) ListUidConnections(uid int32, listener ConnectionListener) error {
+	for _, info := range t.connections.list(uint16(uid), false) {
+		listener.OnConnection(info)
+	}
+	return nil
+}
+
+// CloseConnectionsByTag closes the active connections routed to the outbound tag and returns how
+// many were closed.
+func (t *Tun2ray) CloseConnectionsByTag(tag string) int32 {
+	if tag == "" {
+		return 0
+	}
+	closers := t.connections.closersByTag(tag)
+	for _, closer := range closers {
+		closeIgnore(closer)
+	}
+	return int32(len(closers))
+}
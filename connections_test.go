@@ -0,0 +1,54 @@
+package libcore
+
+import (
+	"testing"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+func TestDuplicateConnection(t *testing.T) {
+	source := v2rayNet.TCPDestination(v2rayNet.ParseAddress("172.19.0.2"), 40000)
+	destination := v2rayNet.TCPDestination(v2rayNet.ParseAddress("1.1.1.1"), 443)
+	newInfo := func(closer *closeCounter) *connInfo {
+		return &connInfo{network: "tcp", source: source, destination: destination, closer: closer, outbound: &outboundTag{}}
+	}
+
+	tun := &Tun2ray{}
+	first, second := newInfo(&closeCounter{}), newInfo(&closeCounter{})
+	if !tun.connections.add(first) || !tun.connections.add(second) {
+		t.Fatal("duplicate rejected by default")
+	}
+	tun.connections.remove(first)
+	tun.connections.remove(second)
+
+	tun.SetDuplicatePolicy(DuplicateReject)
+	first, second = newInfo(&closeCounter{}), newInfo(&closeCounter{})
+	if !tun.connections.add(first) {
+		t.Fatal("first connection rejected")
+	}
+	if tun.connections.add(second) {
+		t.Fatal("duplicate accepted under DuplicateReject")
+	}
+	tun.connections.remove(first)
+	if !tun.connections.add(second) {
+		t.Fatal("connection rejected after the previous one ended")
+	}
+	tun.connections.remove(second)
+
+	tun.SetDuplicatePolicy(DuplicateReset)
+	firstCloser := &closeCounter{}
+	first, second = newInfo(firstCloser), newInfo(&closeCounter{})
+	tun.connections.add(first)
+	if !tun.connections.add(second) {
+		t.Fatal("duplicate rejected under DuplicateReset")
+	}
+	if firstCloser.closed != 1 {
+		t.Fatal("old connection not reset")
+	}
+	tun.connections.remove(first)
+	third := newInfo(&closeCounter{})
+	tun.connections.add(third)
+	if second.closer.(*closeCounter).closed != 1 {
+		t.Fatal("removing the reset connection untracked its replacement")
+	}
+}
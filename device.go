@@ -0,0 +1,34 @@
+package libcore
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DeviceListener is notified when the stack stops reading the TUN device on its own, e.g. because
+// the system closed the fd, so the host can rebuild the tunnel.
+type DeviceListener interface {
+	OnDeviceClosed(reason string)
+}
+
+func (t *Tun2ray) SetDeviceListener(listener DeviceListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.deviceListener = listener
+}
+
+func (t *Tun2ray) onDeviceClosed(err error) {
+	if atomic.LoadInt32(&t.closed) != 0 {
+		return
+	}
+	logrus.Error("device read loop exited: ", err)
+
+	t.access.RLock()
+	listener := t.deviceListener
+	t.access.RUnlock()
+	if listener != nil {
+		listener.OnDeviceClosed(err.Error())
+	}
+}
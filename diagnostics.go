@@ -0,0 +1,27 @@
+package libcore
+
+import (
+	"libcore/gvisor"
+)
+
+type Diagnostics struct {
+	GVisor    bool
+	Pcap      bool
+	PcapError string
+
+	NatFullDropped int64
+}
+
+func (t *Tun2ray) Diagnostics() *Diagnostics {
+	d := &Diagnostics{
+		NatFullDropped: t.GetNatFullDropped(),
+	}
+	if dev, ok := t.dev.(*gvisor.GVisor); ok {
+		d.GVisor = true
+		d.Pcap = dev.Capturing()
+		if err := dev.PcapError(); err != nil {
+			d.PcapError = err.Error()
+		}
+	}
+	return d
+}
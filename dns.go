@@ -0,0 +1,339 @@
+package libcore
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// v2ray's LookupIP doesn't report record TTLs, so answers are cached for a fixed lifetime.
+const (
+	// dnsCacheSize caps the cached answers, including expired ones.
+	dnsCacheSize = 1024
+	// dnsStaleLifetime is how long an expired answer is kept for the stale fail mode.
+	dnsStaleLifetime = time.Hour
+)
+
+type dnsCacheEntry struct {
+	ips      []net.IP
+	expireAt time.Time
+}
+
+// dnsCache caches the answers used by the protected dialer. It is disabled until a lifetime is set.
+type dnsCache struct {
+	access   sync.RWMutex
+	lifetime int32
+	entries  map[string]*dnsCacheEntry
+	// pins are forced answers that override the cache and upstream until they expire.
+	pins map[string]*dnsCacheEntry
+}
+
+func (c *dnsCache) setLifetime(seconds int32) {
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	c.lifetime = seconds
+}
+
+func (c *dnsCache) ttl() time.Duration {
+	c.access.RLock()
+	defer c.access.RUnlock()
+
+	if c.lifetime <= 0 {
+		return 0
+	}
+	return time.Duration(c.lifetime) * time.Second
+}
+
+func (c *dnsCache) lookup(name string, qtype string, resolve func() ([]net.IP, error)) ([]net.IP, error) {
+	if ips := c.pinned(name); ips != nil {
+		return ips, nil
+	}
+	ttl := c.ttl()
+	if ttl == 0 {
+		return resolve()
+	}
+	key := name + "/" + qtype
+
+	c.access.RLock()
+	entry := c.entries[key]
+	c.access.RUnlock()
+	if entry != nil && time.Now().Before(entry.expireAt) {
+		return append([]net.IP(nil), entry.ips...), nil
+	}
+
+	ips, err := resolve()
+	if err == nil && len(ips) > 0 {
+		c.access.Lock()
+		if c.entries == nil {
+			c.entries = map[string]*dnsCacheEntry{}
+		}
+		if _, ok := c.entries[key]; !ok && len(c.entries) >= dnsCacheSize {
+			c.purge()
+		}
+		c.entries[key] = &dnsCacheEntry{
+			ips:      append([]net.IP(nil), ips...),
+			expireAt: time.Now().Add(ttl),
+		}
+		c.access.Unlock()
+	}
+	return ips, err
+}
+
+// purge removes the entries expired for longer than dnsStaleLifetime, or the entry expiring first
+// if that leaves the cache full. The caller holds the write lock.
+func (c *dnsCache) purge() {
+	now := time.Now()
+	var oldestKey string
+	var oldest time.Time
+	for key, entry := range c.entries {
+		if now.Sub(entry.expireAt) > dnsStaleLifetime {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || entry.expireAt.Before(oldest) {
+			oldestKey, oldest = key, entry.expireAt
+		}
+	}
+	if len(c.entries) >= dnsCacheSize {
+		delete(c.entries, oldestKey)
+	}
+}
+
+// stale returns the cached answer even if it expired less than dnsStaleLifetime ago, or nil.
+func (c *dnsCache) stale(name string, qtype string) []net.IP {
+	c.access.RLock()
+	defer c.access.RUnlock()
+
+	entry := c.entries[name+"/"+qtype]
+	if entry == nil || time.Since(entry.expireAt) > dnsStaleLifetime {
+		return nil
+	}
+	return append([]net.IP(nil), entry.ips...)
+}
+
+// DNSCacheEntry is a cached answer, IPs is a comma separated list and ExpiresAt a unix time.
+type DNSCacheEntry struct {
+	Name      string
+	Type      string
+	IPs       string
+	ExpiresAt int64
+}
+
+type DNSCacheListener interface {
+	OnDNSCacheEntry(entry *DNSCacheEntry)
+}
+
+func (c *dnsCache) list() []*DNSCacheEntry {
+	c.access.RLock()
+	defer c.access.RUnlock()
+
+	entries := make([]*DNSCacheEntry, 0, len(c.entries))
+	for key, entry := range c.entries {
+		i := strings.LastIndex(key, "/")
+		ips := make([]string, 0, len(entry.ips))
+		for _, ip := range entry.ips {
+			ips = append(ips, ip.String())
+		}
+		entries = append(entries, &DNSCacheEntry{
+			Name:      key[:i],
+			Type:      key[i+1:],
+			IPs:       strings.Join(ips, ","),
+			ExpiresAt: entry.expireAt.Unix(),
+		})
+	}
+	return entries
+}
+
+func (c *dnsCache) evict(name string, qtype string) bool {
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	key := name + "/" + qtype
+	_, ok := c.entries[key]
+	delete(c.entries, key)
+	return ok
+}
+
+// DNSCacheEntries lists the cached answers, including expired ones kept for the stale fail mode.
+func (t *Tun2ray) DNSCacheEntries(listener DNSCacheListener) error {
+	for _, entry := range t.dnsCache.list() {
+		listener.OnDNSCacheEntry(entry)
+	}
+	return nil
+}
+
+// EvictDNSEntry removes the cached answer of name for the query type, e.g. "IP", and reports
+// whether there was one.
+func (t *Tun2ray) EvictDNSEntry(name string, qtype string) bool {
+	return t.dnsCache.evict(name, qtype)
+}
+
+func (c *dnsCache) flush() {
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	c.entries = nil
+}
+
+// FlushDNSCache clears the DNS answer cache of the protected dialer. Pinned answers are kept.
+func (t *Tun2ray) FlushDNSCache() {
+	t.dnsCache.flush()
+}
+
+// OnNetworkChanged drops the DNS answers learned on the previous network.
+func (t *Tun2ray) OnNetworkChanged() {
+	t.FlushDNSCache()
+}
+
+func pinKey(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+func (c *dnsCache) pinned(name string) []net.IP {
+	key := pinKey(name)
+	c.access.RLock()
+	pin := c.pins[key]
+	c.access.RUnlock()
+	if pin == nil {
+		return nil
+	}
+	if time.Now().Before(pin.expireAt) {
+		return append([]net.IP(nil), pin.ips...)
+	}
+	c.access.Lock()
+	if c.pins[key] == pin {
+		delete(c.pins, key)
+	}
+	c.access.Unlock()
+	return nil
+}
+
+func (c *dnsCache) pin(domain string, ips []net.IP, ttl time.Duration) {
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	if c.pins == nil {
+		c.pins = map[string]*dnsCacheEntry{}
+	}
+	c.pins[pinKey(domain)] = &dnsCacheEntry{
+		ips:      ips,
+		expireAt: time.Now().Add(ttl),
+	}
+}
+
+func (c *dnsCache) unpin(domain string) {
+	c.access.Lock()
+	defer c.access.Unlock()
+
+	delete(c.pins, pinKey(domain))
+}
+
+// PinDNS forces domain to resolve to ips, a comma separated list, for ttlSec seconds. The pin
+// overrides both the cache and the upstream resolver of the protected dialer.
+func (t *Tun2ray) PinDNS(domain string, ips string, ttlSec int32) error {
+	if ttlSec <= 0 {
+		return fmt.Errorf("invalid ttl %d", ttlSec)
+	}
+	var pinned []net.IP
+	for _, s := range strings.Split(ips, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			return fmt.Errorf("invalid ip %q", s)
+		}
+		pinned = append(pinned, ip)
+	}
+	t.dnsCache.pin(domain, pinned, time.Duration(ttlSec)*time.Second)
+	return nil
+}
+
+// UnpinDNS removes the pin of domain before it expires.
+func (t *Tun2ray) UnpinDNS(domain string) {
+	t.dnsCache.unpin(domain)
+}
+
+// SetDNSCacheLifetime enables the DNS cache of the protected dialer, keeping answers for the given
+// seconds regardless of their record TTL, which v2ray doesn't report. 0 disables the cache. At
+// most 1024 answers are cached, and expired ones are kept for an hour for the stale fail mode.
+func (t *Tun2ray) SetDNSCacheLifetime(seconds int32) {
+	t.dnsCache.setLifetime(seconds)
+}
+
+// What the protected dialer does when the DNS client fails to resolve a domain.
+const (
+	DNSFailHard int32 = iota
+	DNSFailStale
+	DNSFailSystem
+)
+
+// SetDNSFailMode sets what happens when the DNS client fails: fail the connection, serve the last
+// cached answer even if expired (needs the cache enabled by SetDNSCacheLifetime), or ask the system
+// resolver.
+func (t *Tun2ray) SetDNSFailMode(mode int32) {
+	atomic.StoreInt32(&t.dnsFailMode, mode)
+}
+
+func (t *Tun2ray) resolveIP(domain string, lookup func() ([]net.IP, error), systemLookup func(string) ([]net.IP, error)) ([]net.IP, error) {
+	ips, err := t.dnsCache.lookup(domain, "IP", func() ([]net.IP, error) {
+		ips, err := lookup()
+		if err != nil {
+			return nil, err
+		}
+		return t.rewriteDNSResponse(domain, ips), nil
+	})
+	if err == nil && len(ips) > 0 {
+		return ips, nil
+	}
+	switch atomic.LoadInt32(&t.dnsFailMode) {
+	case DNSFailStale:
+		if stale := t.dnsCache.stale(domain, "IP"); stale != nil {
+			logrus.Debug("[DNS] serving stale answer for ", domain)
+			return stale, nil
+		}
+	case DNSFailSystem:
+		if fallback, fallbackErr := systemLookup(domain); fallbackErr == nil && len(fallback) > 0 {
+			return fallback, nil
+		}
+	}
+	return ips, err
+}
+
+// DNSResponseRewriter transforms the answers of the protected dialer's lookups before they are
+// cached and used, e.g. to strip IPv6 addresses. Answers are comma separated addresses, returning
+// an empty answer fails the lookup.
+type DNSResponseRewriter interface {
+	RewriteDNSResponse(domain string, answer string) string
+}
+
+func (t *Tun2ray) SetDNSResponseRewriter(rewriter DNSResponseRewriter) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.dnsResponseRewriter = rewriter
+}
+
+func (t *Tun2ray) rewriteDNSResponse(domain string, ips []net.IP) []net.IP {
+	t.access.RLock()
+	rewriter := t.dnsResponseRewriter
+	t.access.RUnlock()
+	if rewriter == nil {
+		return ips
+	}
+
+	answers := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		answers = append(answers, ip.String())
+	}
+	var rewritten []net.IP
+	for _, answer := range strings.Split(rewriter.RewriteDNSResponse(domain, strings.Join(answers, ",")), ",") {
+		if ip := net.ParseIP(strings.TrimSpace(answer)); ip != nil {
+			rewritten = append(rewritten, ip)
+		}
+	}
+	return rewritten
+}
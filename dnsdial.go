@@ -0,0 +1,203 @@
+package libcore
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v4/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+	"github.com/v2fly/v2ray-core/v4/common/session"
+)
+
+// dnsUdpTimeout is how long a query over UDP waits for the answer before it is retried over TCP.
+const dnsUdpTimeout = 2 * time.Second
+
+// dnsTcpTimeout bounds the wait for an answer over TCP, the deadlines of the v2ray connection
+// have no effect.
+const dnsTcpTimeout = 5 * time.Second
+
+// dialDNS dials the DNS server for the Go resolver, which asks for TCP itself when an answer over
+// UDP is truncated.
+func (t *Tun2ray) dialDNS(ctx context.Context, network, address string) (net.Conn, error) {
+	t.onResolverDial(network, address)
+	if strings.HasPrefix(network, "tcp") {
+		return t.dialDNSServer(ctx, v2rayNet.Network_TCP)
+	}
+	conn, err := t.dialDNSServer(ctx, v2rayNet.Network_UDP)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedConn{
+		Conn:  conn,
+		t:     t,
+		ctx:   ctx,
+		reads: make(chan []byte),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+func (t *Tun2ray) dialDNSServer(ctx context.Context, network v2rayNet.Network) (net.Conn, error) {
+	return t.v2ray.dialContext(session.ContextWithInbound(ctx, &session.Inbound{
+		Tag:         "dns-in",
+		SkipFakeDNS: true,
+	}), v2rayNet.Destination{
+		Network: network,
+		Address: v2rayNet.ParseAddress("1.0.0.1"),
+		Port:    53,
+	})
+}
+
+// wrappedConn is a DNS connection over UDP. It keeps the last query so it can be sent again over
+// TCP if no answer arrives within dnsUdpTimeout, after which the connection stays on TCP.
+type wrappedConn struct {
+	net.Conn
+	t   *Tun2ray
+	ctx context.Context
+
+	query []byte
+	tcp   net.Conn
+
+	readOnce  sync.Once
+	reads     chan []byte
+	readErr   error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// readLoop reads the UDP answers, the deadlines of the v2ray connection have no effect so a read
+// can't be abandoned otherwise.
+func (c *wrappedConn) readLoop() {
+	defer close(c.reads)
+	for {
+		p := make([]byte, buf.Size)
+		n, err := c.Conn.Read(p)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		select {
+		case c.reads <- p[:n]:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wrappedConn) Read(p []byte) (int, error) {
+	if c.tcp == nil {
+		c.readOnce.Do(func() {
+			go c.readLoop()
+		})
+		timer := time.NewTimer(dnsUdpTimeout)
+		defer timer.Stop()
+		select {
+		case answer, ok := <-c.reads:
+			if !ok {
+				return 0, c.readErr
+			}
+			return copy(p, answer), nil
+		case <-timer.C:
+		case <-c.ctx.Done():
+			return 0, c.ctx.Err()
+		}
+		if err := c.fallback(); err != nil {
+			return 0, err
+		}
+	}
+	return c.readTCP(p)
+}
+
+type dnsAnswer struct {
+	message []byte
+	err     error
+}
+
+// readTCP reads an answer over TCP within dnsTcpTimeout, closing the connection to abandon the
+// read otherwise.
+func (c *wrappedConn) readTCP(p []byte) (int, error) {
+	answers := make(chan dnsAnswer, 1)
+	go func() {
+		var length [2]byte
+		if _, err := io.ReadFull(c.tcp, length[:]); err != nil {
+			answers <- dnsAnswer{err: err}
+			return
+		}
+		message := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err := io.ReadFull(c.tcp, message)
+		answers <- dnsAnswer{message, err}
+	}()
+
+	timer := time.NewTimer(dnsTcpTimeout)
+	defer timer.Stop()
+	select {
+	case answer := <-answers:
+		if answer.err != nil {
+			return 0, answer.err
+		}
+		return copy(p, answer.message), nil
+	case <-timer.C:
+		closeIgnore(c.tcp)
+		return 0, os.ErrDeadlineExceeded
+	case <-c.ctx.Done():
+		closeIgnore(c.tcp)
+		return 0, c.ctx.Err()
+	}
+}
+
+func (c *wrappedConn) fallback() error {
+	conn, err := c.t.dialDNSServer(c.ctx, v2rayNet.Network_TCP)
+	if err != nil {
+		return err
+	}
+	logrus.Debug("[DNS] no answer over UDP, retrying over TCP")
+	c.tcp = conn
+	return c.writeTCP(c.query)
+}
+
+func (c *wrappedConn) writeTCP(p []byte) error {
+	message := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(message, uint16(len(p)))
+	copy(message[2:], p)
+	_, err := c.tcp.Write(message)
+	return err
+}
+
+func (c *wrappedConn) Write(p []byte) (int, error) {
+	c.query = append(c.query[:0], p...)
+	if c.tcp != nil {
+		if err := c.writeTCP(p); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *wrappedConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, err = c.Read(p)
+	if err == nil {
+		addr = c.Conn.RemoteAddr()
+	}
+	return
+}
+
+func (c *wrappedConn) WriteTo(p []byte, _ net.Addr) (n int, err error) {
+	return c.Write(p)
+}
+
+func (c *wrappedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	if c.tcp != nil {
+		closeIgnore(c.tcp)
+	}
+	return c.Conn.Close()
+}
@@ -0,0 +1,84 @@
+package libcore
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DNS paths that can answer a lookup.
+const (
+	DNSSourceFake int32 = iota
+	DNSSourceReal
+	DNSSourceSystem
+)
+
+var dnsSourceNames = []string{"fake", "real", "system"}
+
+// DNSQueryListener is notified of every lookup sent upstream by the core. Answer is a comma
+// separated list of addresses, message is the error or empty on success.
+type DNSQueryListener interface {
+	OnDNSQuery(domain string, source int32, answer string, message string)
+}
+
+func (t *Tun2ray) SetDNSQueryListener(listener DNSQueryListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.dnsQueryListener = listener
+}
+
+func (t *Tun2ray) onDNSQuery(domain string, source int32, ips []net.IP, err error) {
+	answers := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		answers = append(answers, ip.String())
+	}
+	answer := strings.Join(answers, ",")
+	var message string
+	if err != nil {
+		message = err.Error()
+		logrus.Debugf("[DNS] %s lookup %s failed: %s", dnsSourceNames[source], domain, message)
+	} else {
+		logrus.Debugf("[DNS] %s lookup %s: %s", dnsSourceNames[source], domain, answer)
+	}
+
+	t.access.RLock()
+	listener := t.dnsQueryListener
+	t.access.RUnlock()
+	if listener != nil {
+		listener.OnDNSQuery(domain, source, answer, message)
+	}
+}
+
+// ResolverDialListener is notified each time a lookup of Go's default resolver dials the DNS
+// server through the tunnel, as opposed to the lookups of the core's own resolvers.
+type ResolverDialListener interface {
+	OnResolverDial(network string, address string)
+}
+
+// SetResolverDialListener sets the listener of default resolver dials, nil turns it off.
+func (t *Tun2ray) SetResolverDialListener(listener ResolverDialListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.resolverDialListener = listener
+}
+
+// GetResolverDials returns the number of default resolver dials.
+func (t *Tun2ray) GetResolverDials() int64 {
+	return int64(atomic.LoadUint64(&t.resolverDials))
+}
+
+func (t *Tun2ray) onResolverDial(network string, address string) {
+	atomic.AddUint64(&t.resolverDials, 1)
+
+	t.access.RLock()
+	listener := t.resolverDialListener
+	t.access.RUnlock()
+	if listener != nil {
+		logrus.Debugf("[DNS] default resolver dial: %s %s", network, address)
+		listener.OnResolverDial(network, address)
+	}
+}
@@ -0,0 +1,40 @@
+package libcore
+
+import (
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+// ConnectionFilter decides whether a connection or UDP session may be dispatched, domain is the
+// sniffed domain or empty. It is called synchronously on the handler goroutine before anything is
+// sent, so it must return within a few milliseconds, e.g. by reading rules kept in memory.
+type ConnectionFilter interface {
+	FilterConnection(source string, destination string, uid int32, domain string) bool
+}
+
+func (t *Tun2ray) SetConnectionFilter(filter ConnectionFilter) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.connectionFilter = filter
+}
+
+func (t *Tun2ray) getConnectionFilter() ConnectionFilter {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	return t.connectionFilter
+}
+
+// allowConnection consults the connection filter, allowing everything if none is set.
+func (t *Tun2ray) allowConnection(source v2rayNet.Destination, destination v2rayNet.Destination, uid uint16, domain string) bool {
+	filter := t.getConnectionFilter()
+	if filter == nil {
+		return true
+	}
+	if filter.FilterConnection(source.NetAddr(), destination.NetAddr(), int32(uid), domain) {
+		return true
+	}
+	logrus.Debugf("[%s] filtered: %s ==> %s", destination.Network.SystemString(), source.NetAddr(), destination.NetAddr())
+	return false
+}
@@ -0,0 +1,105 @@
+package libcore
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// markFirstByte records the time to the first byte sent back to the app, once per session.
+func (c *connInfo) markFirstByte(app *appStats) {
+	if atomic.LoadInt64(&c.firstByte) != 0 {
+		return
+	}
+	ms := time.Since(c.start).Milliseconds()
+	if ms == 0 {
+		ms = 1
+	}
+	if !atomic.CompareAndSwapInt64(&c.firstByte, 0, ms) {
+		return
+	}
+	if app != nil {
+		atomic.AddUint64(&app.firstByteSum, uint64(ms))
+		atomic.AddUint32(&app.firstByteCount, 1)
+	}
+}
+
+// FirstTrafficListener is notified once, when the first response is relayed back to an app.
+type FirstTrafficListener interface {
+	OnFirstTraffic()
+}
+
+// OnFirstTraffic sets the listener of the first relayed response. It is called right away if
+// traffic already flowed.
+func (t *Tun2ray) OnFirstTraffic(listener FirstTrafficListener) {
+	t.access.Lock()
+	flowed := t.firstTraffic != 0
+	if !flowed {
+		t.firstTrafficListener = listener
+	}
+	t.access.Unlock()
+
+	if flowed {
+		listener.OnFirstTraffic()
+	}
+}
+
+func (t *Tun2ray) onTraffic() {
+	if atomic.LoadInt32(&t.firstTraffic) != 0 {
+		return
+	}
+	t.access.Lock()
+	if t.firstTraffic != 0 {
+		t.access.Unlock()
+		return
+	}
+	atomic.StoreInt32(&t.firstTraffic, 1)
+	listener := t.firstTrafficListener
+	t.firstTrafficListener = nil
+	t.access.Unlock()
+
+	if listener != nil {
+		listener.OnFirstTraffic()
+	}
+}
+
+type firstByteConn struct {
+	net.Conn
+	info *connInfo
+	app  *appStats
+	t    *Tun2ray
+}
+
+func (c *firstByteConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.info.markFirstByte(c.app)
+		c.t.onTraffic()
+	}
+	return
+}
+
+type firstBytePacketConn struct {
+	packetConn
+	info *connInfo
+	app  *appStats
+	t    *Tun2ray
+}
+
+func (c firstBytePacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.packetConn.ReadFrom(p)
+	if err == nil {
+		c.info.markFirstByte(c.app)
+		c.t.onTraffic()
+	}
+	return
+}
+
+func (c firstBytePacketConn) readFrom() (p []byte, addr net.Addr, err error) {
+	p, addr, err = c.packetConn.readFrom()
+	if err == nil {
+		c.info.markFirstByte(c.app)
+		c.t.onTraffic()
+	}
+	return
+}
@@ -14,6 +14,22 @@ import (
 // bufConfig defines the shape of the vectorised view used to read packets from the NIC.
 var bufConfig = []int{128, 256, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768}
 
+// readBufferSizes returns the first n sizes of bufConfig, extended until they can hold a packet of mtu.
+func readBufferSizes(n int, mtu int) []int {
+	if n <= 0 || n > len(bufConfig) {
+		return bufConfig
+	}
+	total := 0
+	for _, size := range bufConfig[:n] {
+		total += size
+	}
+	for total < mtu && n < len(bufConfig) {
+		total += bufConfig[n]
+		n++
+	}
+	return bufConfig[:n]
+}
+
 type iovecBuffer struct {
 	// views are the actual buffers that hold the packet contents.
 	views []buffer.View
@@ -111,7 +127,7 @@ type readVDispatcher struct {
 	buf *iovecBuffer
 }
 
-func newReadVDispatcher(fd int, e *rwEndpoint) (*readVDispatcher, error) {
+func newReadVDispatcher(fd int, e *rwEndpoint, sizes []int) (*readVDispatcher, error) {
 	stopFd, err := newStopFd()
 	if err != nil {
 		return nil, err
@@ -121,13 +137,16 @@ func newReadVDispatcher(fd int, e *rwEndpoint) (*readVDispatcher, error) {
 		fd:     fd,
 		e:      e,
 	}
-	d.buf = newIovecBuffer(bufConfig)
+	d.buf = newIovecBuffer(sizes)
 	return d, nil
 }
 
 // dispatch reads one packet from the file descriptor and dispatches it.
 func (d *readVDispatcher) dispatch() (bool, tcpip.Error) {
 	n, err := rawfile.BlockingReadvUntilStopped(d.efd, d.fd, d.buf.nextIovecs())
+	if n == 0 && err == nil {
+		return false, &tcpip.ErrClosedForReceive{}
+	}
 	if n <= 0 || err != nil {
 		return false, err
 	}
@@ -1,6 +1,7 @@
 package gvisor
 
 import (
+	"errors"
 	"sync"
 
 	"golang.org/x/sys/unix"
@@ -22,14 +23,16 @@ type rwEndpoint struct {
 
 	inbound    *readVDispatcher
 	dispatcher stack.NetworkDispatcher
+	// onClosed is called when the read loop exits on an error instead of being stopped.
+	onClosed func(error)
 }
 
-func newRwEndpoint(dev int32, mtu int32) (*rwEndpoint, error) {
+func newRwEndpoint(dev int32, mtu int32, sizes []int) (*rwEndpoint, error) {
 	e := &rwEndpoint{
 		fd:  int(dev),
 		mtu: uint32(mtu),
 	}
-	i, err := newReadVDispatcher(e.fd, e)
+	i, err := newReadVDispatcher(e.fd, e, sizes)
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +61,9 @@ func (e *rwEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
 		e.dispatcher = dispatcher
 		e.wg.Add(1)
 		go func() {
-			e.dispatchLoop(e.inbound)
+			if err := e.dispatchLoop(e.inbound); err != nil && e.onClosed != nil {
+				e.onClosed(errors.New(err.String()))
+			}
 			e.wg.Done()
 		}()
 	}
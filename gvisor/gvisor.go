@@ -1,12 +1,15 @@
 package gvisor
 
 import (
-	"io"
+	"errors"
 	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/sirupsen/logrus"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/qdisc/fifo"
 	"gvisor.dev/gvisor/pkg/tcpip/link/sniffer"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
@@ -23,28 +26,54 @@ type GVisor struct {
 	Endpoint stack.LinkEndpoint
 	PcapFile *os.File
 	Stack    *stack.Stack
+
+	pcap *pcapFileWrapper
+	rw   *rwEndpoint
+	// link is the endpoint below the capture.
+	link stack.LinkEndpoint
+	// queueLength and readBufferSizes are the queue and read buffers the stack was created with.
+	queueLength     int
+	readBufferSizes []int
 }
 
 func (t *GVisor) Close() error {
 	t.Stack.Close()
-	if t.PcapFile != nil {
-		_ = t.PcapFile.Close()
-	}
+	t.pcap.stop()
 	return nil
 }
 
 const DefaultNIC tcpip.NICID = 0x01
 
-func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, pcap bool, pcapFile *os.File, snapLen uint32, ipv6Mode int32) (*GVisor, error) {
-	var endpoint stack.LinkEndpoint
-	endpoint, _ = newRwEndpoint(dev, mtu)
+// New creates the gVisor stack on the TUN device.
+// A positive queueLength queues outgoing packets in a FIFO of that length.
+// readBuffers limits how many bufConfig views a packet is read into; 0 keeps all of them.
+// onClosed, if set, is called when reading the device fails and the stack stops receiving.
+func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, pcap bool, pcapFile *os.File, snapLen uint32, ipv6Mode int32, queueLength int32, readBuffers int32, onClosed func(error)) (*GVisor, error) {
+	sizes := readBufferSizes(int(readBuffers), int(mtu))
+	rw, err := newRwEndpoint(dev, mtu, sizes)
+	if err != nil {
+		return nil, err
+	}
+	rw.onClosed = onClosed
+	var endpoint stack.LinkEndpoint = rw
+	if queueLength > 0 {
+		endpoint = fifo.New(endpoint, 1, int(queueLength))
+	} else {
+		queueLength = 0
+	}
+	link := endpoint
+	// The capture endpoint is always installed so capture can start at runtime. It only
+	// serializes packets while a file is attached.
+	pcapWriter := &pcapFileWrapper{}
 	if pcap {
-		pcapEndpoint, err := sniffer.NewWithWriter(endpoint, &pcapFileWrapper{pcapFile}, snapLen)
-		if err != nil {
-			return nil, err
-		}
-		endpoint = pcapEndpoint
+		pcapWriter.file = pcapFile
+	}
+	pcapEndpoint, err := sniffer.NewWithWriter(endpoint, pcapWriter, snapLen)
+	if err != nil {
+		return nil, err
 	}
+	endpoint = pcapEndpoint
+	pcapWriter.setCapturing()
 	var o stack.Options
 	switch ipv6Mode {
 	case 0:
@@ -100,19 +129,106 @@ func New(dev int32, mtu int32, handler tun.Handler, nicId tcpip.NICID, pcap bool
 	gMust(s.SetSpoofing(nicId, true))
 	gMust(s.SetPromiscuousMode(nicId, true))
 
-	return &GVisor{endpoint, pcapFile, s}, nil
+	return &GVisor{
+		Endpoint: endpoint,
+		PcapFile: pcapFile,
+		Stack:    s,
+		pcap:     pcapWriter,
+		rw:       rw,
+		link:     link,
+
+		queueLength:     int(queueLength),
+		readBufferSizes: sizes,
+	}, nil
+}
+
+// PcapError returns the error that stopped the packet capture, if any.
+func (t *GVisor) PcapError() error {
+	t.pcap.access.Lock()
+	defer t.pcap.access.Unlock()
+	return t.pcap.err
+}
+
+// Capturing reports whether packets are being written to a pcap file.
+func (t *GVisor) Capturing() bool {
+	t.pcap.access.Lock()
+	defer t.pcap.access.Unlock()
+	return t.pcap.file != nil && t.pcap.err == nil
+}
+
+// StartPcap starts writing packets to file, which is closed by StopPcap.
+func (t *GVisor) StartPcap(file *os.File) error {
+	return t.pcap.start(file)
+}
+
+func (t *GVisor) StopPcap() {
+	t.pcap.stop()
 }
 
+// pcapFileWrapper stops the capture on the first write error instead of failing the sniffer
+// endpoint, so the tunnel keeps forwarding. Without a file it keeps the pcap header written by
+// the sniffer for the file attached later.
 type pcapFileWrapper struct {
-	io.Writer
+	access sync.Mutex
+	header []byte
+	file   *os.File
+	err    error
 }
 
 func (w *pcapFileWrapper) Write(p []byte) (n int, err error) {
-	n, err = w.Writer.Write(p)
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	if w.header == nil {
+		w.header = append([]byte(nil), p...)
+	}
+	if w.file == nil || w.err != nil {
+		return len(p), nil
+	}
+	_, err = w.file.Write(p)
 	if err != nil {
-		logrus.Debug("write pcap file failed: ", err)
+		w.err = err
+		logrus.Warn("write pcap file failed, capture stopped: ", err)
+		_ = w.file.Close()
+		atomic.StoreUint32(&sniffer.LogPacketsToPCAP, 0)
+	}
+	return len(p), nil
+}
+
+// setCapturing makes the sniffer serialize packets only while a file is attached.
+func (w *pcapFileWrapper) setCapturing() {
+	var capturing uint32
+	if w.file != nil && w.err == nil {
+		capturing = 1
+	}
+	atomic.StoreUint32(&sniffer.LogPacketsToPCAP, capturing)
+}
+
+func (w *pcapFileWrapper) start(file *os.File) error {
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	if w.file != nil && w.err == nil {
+		return errors.New("pcap already started")
+	}
+	if _, err := file.Write(w.header); err != nil {
+		return err
+	}
+	w.file = file
+	w.err = nil
+	w.setCapturing()
+	return nil
+}
+
+func (w *pcapFileWrapper) stop() {
+	w.access.Lock()
+	defer w.access.Unlock()
+
+	if w.file != nil && w.err == nil {
+		_ = w.file.Close()
 	}
-	return n, nil
+	w.file = nil
+	w.setCapturing()
 }
 
 func gMust(err tcpip.Error) {
@@ -0,0 +1,67 @@
+package gvisor
+
+import (
+	"io"
+	"testing"
+
+	"github.com/v2fly/v2ray-core/v4/common/net"
+	"golang.org/x/sys/unix"
+)
+
+type nopHandler struct{}
+
+func (nopHandler) NewConnection(source net.Destination, destination net.Destination, conn net.Conn) {
+	conn.Close()
+}
+
+func (nopHandler) NewPacket(source net.Destination, destination net.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	closer.Close()
+}
+
+func TestQueueConfig(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+
+	g, err := New(int32(fds[0]), 1500, nopHandler{}, DefaultNIC, false, nil, 0, 0, 64, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if n := len(g.readBufferSizes); n != 5 {
+		t.Fatalf("read buffers: want 5 to hold the mtu, got %d", n)
+	}
+	if g.link == g.rw {
+		t.Fatal("endpoint not wrapped with a queue length")
+	}
+	if g.queueLength != 64 {
+		t.Fatalf("queue length: want 64, got %d", g.queueLength)
+	}
+}
+
+func TestQueueConfigDefault(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+
+	g, err := New(int32(fds[0]), 1500, nopHandler{}, DefaultNIC, false, nil, 0, 0, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if g.link != g.rw {
+		t.Fatal("endpoint wrapped without a queue length")
+	}
+	if g.queueLength != 0 {
+		t.Fatalf("queue length: want 0, got %d", g.queueLength)
+	}
+	if n := len(g.readBufferSizes); n != len(bufConfig) {
+		t.Fatalf("read buffers: want %d, got %d", len(bufConfig), n)
+	}
+}
@@ -0,0 +1,121 @@
+package libcore
+
+import (
+	"io"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// IdleListener is notified when the tunnel enters and leaves the idle state, so the host can
+// pause its own periodic work, like polling traffic stats, while idle.
+type IdleListener interface {
+	OnIdleChanged(idle bool)
+}
+
+func (t *Tun2ray) SetIdleListener(listener IdleListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.idleListener = listener
+}
+
+// SetAutoIdle makes the tunnel go idle when there are no TCP connections and no UDP traffic for
+// the given seconds. Entering idle closes the remaining UDP sessions instead of waiting for their
+// 5 minute timeout, returns free memory to the system, stops the idle check and notifies the idle
+// listener. The next connection or packet resumes it, 0 disables.
+func (t *Tun2ray) SetAutoIdle(seconds int32) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+		t.idleTimer = nil
+	}
+	t.idlePeriod = time.Duration(seconds) * time.Second
+	if seconds <= 0 {
+		return
+	}
+	var lastBytes uint64
+	var timer *time.Timer
+	timer = time.AfterFunc(t.idlePeriod, func() {
+		if atomic.LoadInt32(&t.idle) == 1 {
+			return
+		}
+		tcp, bytes := t.connections.activity()
+		idle := tcp == 0 && bytes == lastBytes && atomic.CompareAndSwapInt32(&t.idle, 0, 1)
+		lastBytes = bytes
+		if idle {
+			t.enterIdle()
+			return
+		}
+
+		t.access.Lock()
+		if t.idleTimer == timer {
+			timer.Reset(t.idlePeriod)
+		}
+		t.access.Unlock()
+	})
+	t.idleTimer = timer
+}
+
+// enterIdle runs once the idle state is entered, the idle check stays stopped until wake.
+func (t *Tun2ray) enterIdle() {
+	closers := t.connections.udpClosers()
+	logrus.Debug("entering idle, closing ", len(closers), " udp sessions")
+	for _, closer := range closers {
+		closeIgnore(closer)
+	}
+	debug.FreeOSMemory()
+	t.notifyIdle(true)
+}
+
+// wake leaves the idle state on new activity and restarts the idle check.
+func (t *Tun2ray) wake() {
+	if !atomic.CompareAndSwapInt32(&t.idle, 1, 0) {
+		return
+	}
+	logrus.Debug("resuming from idle")
+	t.access.Lock()
+	if t.idleTimer != nil {
+		t.idleTimer.Reset(t.idlePeriod)
+	}
+	t.access.Unlock()
+	t.notifyIdle(false)
+}
+
+func (t *Tun2ray) notifyIdle(idle bool) {
+	t.access.RLock()
+	listener := t.idleListener
+	t.access.RUnlock()
+	if listener != nil {
+		listener.OnIdleChanged(idle)
+	}
+}
+
+// activity returns the active TCP connections and the bytes transferred by the active sessions.
+func (t *connTable) activity() (int32, uint64) {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	var bytes uint64
+	for _, c := range t.conns {
+		bytes += atomic.LoadUint64(&c.uplink) + atomic.LoadUint64(&c.downlink)
+	}
+	return t.tcp.count, bytes
+}
+
+func (t *connTable) udpClosers() []io.Closer {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	var closers []io.Closer
+	for _, c := range t.conns {
+		if c.network == "udp" {
+			closers = append(closers, c.closer)
+		}
+	}
+	return closers
+}
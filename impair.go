@@ -0,0 +1,138 @@
+package libcore
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SetNetworkImpairment delays every write back to apps by latencyMs and drops lossPercent of the
+// UDP datagrams sent back, to test apps over a degraded tunnel. It only works in debug mode and
+// 0, 0 turns it off.
+func (t *Tun2ray) SetNetworkImpairment(latencyMs int32, lossPercent int32) {
+	if !t.debug {
+		logrus.Warn("network impairment requires debug mode")
+		return
+	}
+	atomic.StoreInt32(&t.impairLatency, latencyMs)
+	atomic.StoreInt32(&t.impairLoss, lossPercent)
+}
+
+func (t *Tun2ray) impairDelay() time.Duration {
+	return time.Duration(atomic.LoadInt32(&t.impairLatency)) * time.Millisecond
+}
+
+func (t *Tun2ray) impairDrop() bool {
+	loss := atomic.LoadInt32(&t.impairLoss)
+	return loss > 0 && rand.Int31n(100) < loss
+}
+
+// delayLine runs writes once the impairment latency has passed, in the order they were queued,
+// so the latency doesn't also cap the throughput. A failed write fails the later ones.
+type delayLine struct {
+	queue     chan delayedWrite
+	done      chan struct{}
+	exited    chan struct{}
+	closeOnce sync.Once
+	err       atomic.Value
+}
+
+type delayedWrite struct {
+	due   time.Time
+	write func() error
+}
+
+func newDelayLine() *delayLine {
+	l := &delayLine{
+		queue:  make(chan delayedWrite, 1024),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go l.loop()
+	return l
+}
+
+func (l *delayLine) loop() {
+	defer close(l.exited)
+	for {
+		select {
+		case w := <-l.queue:
+			if l.error() != nil {
+				continue
+			}
+			if wait := time.Until(w.due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-l.done:
+					timer.Stop()
+					return
+				}
+			}
+			if err := w.write(); err != nil {
+				l.err.Store(err)
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *delayLine) error() error {
+	err, _ := l.err.Load().(error)
+	return err
+}
+
+// schedule queues the write to run after delay, returning the error of an earlier write.
+func (l *delayLine) schedule(delay time.Duration, write func() error) error {
+	if err := l.error(); err != nil {
+		return err
+	}
+	select {
+	case l.queue <- delayedWrite{time.Now().Add(delay), write}:
+		return nil
+	case <-l.done:
+		return io.ErrClosedPipe
+	}
+}
+
+// close drops the pending writes and waits for the running one.
+func (l *delayLine) close() {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	<-l.exited
+}
+
+type impairedConn struct {
+	net.Conn
+	t    *Tun2ray
+	line *delayLine
+}
+
+func newImpairedConn(conn net.Conn, t *Tun2ray) *impairedConn {
+	return &impairedConn{conn, t, newDelayLine()}
+}
+
+func (c *impairedConn) Write(b []byte) (n int, err error) {
+	data := append([]byte(nil), b...)
+	err = c.line.schedule(c.t.impairDelay(), func() error {
+		_, err := c.Conn.Write(data)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *impairedConn) Close() error {
+	err := c.Conn.Close()
+	c.line.close()
+	return err
+}
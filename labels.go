@@ -0,0 +1,94 @@
+package libcore
+
+import (
+	"sync/atomic"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+// LabelDecider labels connections for ReadLabelTraffics, an empty label leaves the connection unaccounted.
+type LabelDecider interface {
+	DecideLabel(source string, destination string, uid int32) string
+}
+
+type LabelStats struct {
+	Label string
+
+	Uplink        int64
+	Downlink      int64
+	UplinkTotal   int64
+	DownlinkTotal int64
+}
+
+type LabelTrafficListener interface {
+	UpdateLabelStats(s *LabelStats)
+}
+
+type labelStats struct {
+	uplink        uint64
+	downlink      uint64
+	uplinkTotal   uint64
+	downlinkTotal uint64
+}
+
+func (t *Tun2ray) SetLabelDecider(decider LabelDecider) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.labelDecider = decider
+}
+
+func (t *Tun2ray) labelStatsFor(source v2rayNet.Destination, destination v2rayNet.Destination, uid uint16) *labelStats {
+	t.access.RLock()
+	decider := t.labelDecider
+	t.access.RUnlock()
+	if decider == nil {
+		return nil
+	}
+	label := decider.DecideLabel(source.NetAddr(), destination.NetAddr(), int32(uid))
+	if label == "" {
+		return nil
+	}
+
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if t.labelStats == nil {
+		t.labelStats = map[string]*labelStats{}
+	}
+	stats := t.labelStats[label]
+	if stats == nil {
+		stats = &labelStats{}
+		t.labelStats[label] = stats
+	}
+	return stats
+}
+
+func (t *Tun2ray) ReadLabelTraffics(listener LabelTrafficListener) error {
+	var stats []*LabelStats
+	t.access.RLock()
+	for label, stat := range t.labelStats {
+		export := &LabelStats{
+			Label: label,
+		}
+
+		uplink := atomic.SwapUint64(&stat.uplink, 0)
+		uplinkTotal := atomic.AddUint64(&stat.uplinkTotal, uplink)
+		export.Uplink = int64(uplink)
+		export.UplinkTotal = int64(uplinkTotal)
+
+		downlink := atomic.SwapUint64(&stat.downlink, 0)
+		downlinkTotal := atomic.AddUint64(&stat.downlinkTotal, downlink)
+		export.Downlink = int64(downlink)
+		export.DownlinkTotal = int64(downlinkTotal)
+
+		stats = append(stats, export)
+	}
+	t.access.RUnlock()
+
+	for _, stat := range stats {
+		listener.UpdateLabelStats(stat)
+	}
+
+	return nil
+}
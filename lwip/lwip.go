@@ -1,9 +1,11 @@
 package lwip
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/v2fly/v2ray-core/v4/common/bytespool"
@@ -24,7 +26,9 @@ type LwIP struct {
 	Handler tun.Handler
 }
 
-func New(dev *os.File, mtu int32, handler tun.Handler) (*LwIP, error) {
+// New starts the lwip stack on the TUN device. onClosed, if set, is called when reading the
+// device fails for good.
+func New(dev *os.File, mtu int32, handler tun.Handler, onClosed func(error)) (*LwIP, error) {
 	t := &LwIP{
 		pool: bytespool.GetPool(mtu),
 
@@ -42,6 +46,9 @@ func New(dev *os.File, mtu int32, handler tun.Handler) (*LwIP, error) {
 			err := t.processPacket()
 			if err != nil {
 				logrus.Warn(err.Error())
+				if onClosed != nil {
+					onClosed(err)
+				}
 				return
 			}
 		}
@@ -56,6 +63,9 @@ func (l *LwIP) processPacket() error {
 
 	length, err := l.Dev.Read(buffer)
 	if err != nil {
+		if errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EBADF) {
+			return newError("TUN closed").Base(err)
+		}
 		logrus.Warnf("failed to read packet from TUN: %v", err)
 		return nil
 	}
@@ -0,0 +1,49 @@
+package libcore
+
+import (
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+// NatFullListener is notified when the first packet of a UDP session is dropped because the
+// session limit is reached.
+type NatFullListener interface {
+	OnNatFull(source string, destination string, uid int32)
+}
+
+// SetMaxUdpSessions limits the number of concurrent UDP sessions, 0 is unlimited.
+func (t *Tun2ray) SetMaxUdpSessions(limit int32) {
+	atomic.StoreInt32(&t.maxUdpSessions, limit)
+}
+
+func (t *Tun2ray) SetNatFullListener(listener NatFullListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.natFullListener = listener
+}
+
+// GetNatFullDropped returns the number of packets dropped because the session limit was reached.
+func (t *Tun2ray) GetNatFullDropped() int64 {
+	return int64(atomic.LoadUint64(&t.natDropped))
+}
+
+// natFull reports whether a new UDP session would exceed the session limit, counting the drop.
+func (t *Tun2ray) natFull(source v2rayNet.Destination, destination v2rayNet.Destination, uid uint16) bool {
+	limit := atomic.LoadInt32(&t.maxUdpSessions)
+	if limit <= 0 || t.connections.udpSessions() < limit {
+		return false
+	}
+	atomic.AddUint64(&t.natDropped, 1)
+	logrus.Debugf("[UDP] dropped, nat table full: %s ==> %s", source.NetAddr(), destination.NetAddr())
+
+	t.access.RLock()
+	listener := t.natFullListener
+	t.access.RUnlock()
+	if listener != nil {
+		listener.OnNatFull(source.NetAddr(), destination.NetAddr(), int32(uid))
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package libcore
+
+import (
+	"context"
+	"sync/atomic"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+	"github.com/v2fly/v2ray-core/v4/common/session"
+	routingSession "github.com/v2fly/v2ray-core/v4/features/routing/session"
+)
+
+// outboundTag records the outbound tag a connection is dispatched to.
+type outboundTag struct {
+	tag atomic.Value
+}
+
+func (o *outboundTag) set(tag string) {
+	o.tag.Store(tag)
+}
+
+func (o *outboundTag) get() string {
+	if tag, ok := o.tag.Load().(string); ok {
+		return tag
+	}
+	return ""
+}
+
+// pickOutbound returns the tag of the outbound the dispatcher picks for the destination, resolved
+// the same way: the forced tag, then the router, then the default outbound. domain is the domain
+// sniffed by the core, if any. Domains sniffed by the dispatcher itself and balancers with a random
+// strategy may make it pick a different outbound.
+func (instance *V2RayInstance) pickOutbound(ctx context.Context, destination v2rayNet.Destination, domain string) string {
+	if tag := session.GetForcedOutboundTagFromContext(ctx); tag != "" {
+		return tag
+	}
+	if instance.router != nil {
+		outbound := &session.Outbound{Target: destination}
+		if domain != "" {
+			outbound.RouteTarget = v2rayNet.Destination{
+				Network: destination.Network,
+				Address: v2rayNet.DomainAddress(domain),
+				Port:    destination.Port,
+			}
+		}
+		route, err := instance.router.PickRoute(routingSession.AsRoutingContext(session.ContextWithOutbound(ctx, outbound)))
+		if err == nil && instance.outboundManager.GetHandler(route.GetOutboundTag()) != nil {
+			return route.GetOutboundTag()
+		}
+	}
+	if handler := instance.outboundManager.GetDefaultHandler(); handler != nil {
+		return handler.Tag()
+	}
+	return ""
+}
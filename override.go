@@ -0,0 +1,47 @@
+package libcore
+
+import (
+	"context"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v4/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+type DialOverride func(ctx context.Context, destination v2rayNet.Destination) (net.Conn, error)
+
+// SetDialOverride makes NewConnection relay TCP connections to the conn returned by dial instead
+// of dispatching them into v2ray, nil restores dispatching. It is meant for tests and local
+// interceptors embedding the core in Go.
+func (t *Tun2ray) SetDialOverride(dial DialOverride) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.dialOverride = dial
+}
+
+func (t *Tun2ray) getDialOverride() DialOverride {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	return t.dialOverride
+}
+
+func relayOverride(ctx context.Context, dial DialOverride, destination v2rayNet.Destination, conn net.Conn) {
+	remote, err := dial(ctx, destination)
+	if err != nil {
+		logrus.Errorf("[TCP] dial override failed: %s", err.Error())
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = buf.Copy(buf.NewReader(remote), buf.NewWriter(conn))
+		closeIgnore(conn)
+		close(done)
+	}()
+	_ = buf.Copy(buf.NewReader(conn), buf.NewWriter(remote))
+	closeIgnore(remote)
+	<-done
+}
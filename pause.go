@@ -0,0 +1,62 @@
+package libcore
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Pause stops forwarding without tearing down v2ray or the stack. New TCP
+// connections and datagrams from the device are dropped; open TCP links and
+// replies of existing UDP sessions are held until Resume is called.
+func (t *Tun2ray) Pause() {
+	t.pauseAccess.Lock()
+	defer t.pauseAccess.Unlock()
+
+	if t.isPaused() {
+		return
+	}
+	t.resumed = make(chan struct{})
+	atomic.StoreInt32(&t.paused, 1)
+}
+
+// Resume releases the links held by Pause. Sessions dropped while paused are not restored.
+func (t *Tun2ray) Resume() {
+	t.pauseAccess.Lock()
+	defer t.pauseAccess.Unlock()
+
+	if !t.isPaused() {
+		return
+	}
+	atomic.StoreInt32(&t.paused, 0)
+	close(t.resumed)
+}
+
+func (t *Tun2ray) isPaused() bool {
+	return atomic.LoadInt32(&t.paused) == 1
+}
+
+func (t *Tun2ray) waitResume() {
+	if !t.isPaused() {
+		return
+	}
+	t.pauseAccess.Lock()
+	resumed := t.resumed
+	t.pauseAccess.Unlock()
+	<-resumed
+}
+
+type pausableConn struct {
+	net.Conn
+	t *Tun2ray
+}
+
+func (c *pausableConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.t.waitResume()
+	return
+}
+
+func (c *pausableConn) Write(b []byte) (n int, err error) {
+	c.t.waitResume()
+	return c.Conn.Write(b)
+}
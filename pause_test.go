@@ -0,0 +1,69 @@
+package libcore
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+type closeCounter struct {
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestPauseResume(t *testing.T) {
+	tun := &Tun2ray{udpTable: &natTable{}}
+	source := v2rayNet.TCPDestination(v2rayNet.ParseAddress("172.19.0.2"), 40000)
+	destination := v2rayNet.TCPDestination(v2rayNet.ParseAddress("1.1.1.1"), 443)
+
+	tun.Pause()
+
+	local, remote := net.Pipe()
+	tun.NewConnection(source, destination, local)
+	if _, err := remote.Write([]byte{0}); err == nil {
+		t.Fatal("connection not closed while paused")
+	}
+
+	closer := &closeCounter{}
+	tun.NewPacket(source, destination, []byte{0}, func([]byte, *net.UDPAddr) (int, error) {
+		t.Fatal("unexpected write back while paused")
+		return 0, nil
+	}, closer)
+	if closer.closed != 1 {
+		t.Fatal("packet closer not closed while paused")
+	}
+	if tun.udpTable.Get(source.NetAddr()) != nil {
+		t.Fatal("udp session created while paused")
+	}
+
+	local, remote = net.Pipe()
+	conn := &pausableConn{local, tun}
+	go remote.Write([]byte("ping"))
+	read := make(chan struct{})
+	go func() {
+		_, _ = conn.Read(make([]byte, 4))
+		close(read)
+	}()
+	select {
+	case <-read:
+		t.Fatal("read not held while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	tun.Resume()
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("read still held after resume")
+	}
+	if tun.isPaused() {
+		t.Fatal("still paused after resume")
+	}
+	closeIgnore(local, remote)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -61,10 +62,15 @@ func (dialer protectedDialer) Dial(ctx context.Context, source v2rayNet.Address,
 }
 
 func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address, destination v2rayNet.Destination, sockopt *internet.SocketConfig) (conn net.Conn, err error) {
+	preserve := sourcePortFromContext(ctx)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	destIp := destination.Address.IP()
 	ipv6 := len(destIp) != net.IPv4len
+	if !ipv6 && ipv4Mapped && ipv6Mode != 0 {
+		destIp = destIp.To16()
+		ipv6 = true
+	}
 	fd, err := getFd(destination.Network, ipv6)
 	if err != nil {
 		return nil, err
@@ -78,6 +84,14 @@ func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address,
 		internet.ApplySockopt(sockopt, destination, uintptr(fd), ctx)
 	}
 
+	if preserve != nil {
+		preserve.bind(fd, ipv6, destination)
+	}
+
+	if destination.Network == v2rayNet.Network_TCP {
+		setTcpProbe(fd)
+	}
+
 	var sockaddr unix.Sockaddr
 	if !ipv6 {
 		socketAddress := &unix.SockaddrInet4{
@@ -93,8 +107,9 @@ func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address,
 		sockaddr = socketAddress
 	}
 
-	err = unix.Connect(fd, sockaddr)
+	err = connect(ctx, fd, sockaddr)
 	if err != nil {
+		unix.Close(fd)
 		return nil, err
 	}
 
@@ -128,6 +143,96 @@ func (dialer protectedDialer) dial(ctx context.Context, source v2rayNet.Address,
 	return conn, nil
 }
 
+// connect connects the socket without blocking past the deadline of ctx, a blocking connect
+// would wait for the system timeout on a blackholed network.
+func connect(ctx context.Context, fd int, sockaddr unix.Sockaddr) error {
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return err
+	}
+	err := unix.Connect(fd, sockaddr)
+	if err == unix.EINPROGRESS {
+		err = waitConnect(ctx, fd)
+	}
+	if err != nil {
+		return err
+	}
+	return unix.SetNonblock(fd, false)
+}
+
+func waitConnect(ctx context.Context, fd int) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+		// poll in slices so a cancelled ctx is noticed
+		n, err := unix.Poll(fds, 100)
+		if err == unix.EINTR || n == 0 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			return err
+		}
+		if soErr != 0 {
+			return unix.Errno(soErr)
+		}
+		return nil
+	}
+}
+
+// ipv6ProbeDestination is a public IPv6 DNS server used to probe IPv6 reachability.
+var ipv6ProbeDestination = v2rayNet.TCPDestination(v2rayNet.ParseAddress("2001:4860:4860::8888"), 53)
+
+// ProbeIPv6 reports whether an IPv6 connection can be established. It connects a protected
+// socket, so the probe goes out of the underlying network and never loops back into the TUN.
+// It is false without a protector or when IPv6 is disabled.
+func ProbeIPv6() bool {
+	if fdProtector == nil || ipv6Mode == 0 {
+		return false
+	}
+	conn, err := protectedDialer{}.dial(context.Background(), nil, ipv6ProbeDestination, nil)
+	if err != nil {
+		logrus.Debug("ipv6 probe failed: ", err)
+		return false
+	}
+	closeIgnore(conn)
+	return true
+}
+
+// tcpProbeInterval is the idle time in seconds before outbound TCP sockets are probed, 0 is off.
+var tcpProbeInterval int32
+
+// SetTcpProbeInterval makes outbound TCP sockets send keepalive probes after the given idle
+// seconds, so a half-open connection is reset after three unanswered probes instead of staying
+// stuck. The probes are empty segments that don't reach the app. 0 turns probing off.
+func SetTcpProbeInterval(seconds int32) {
+	atomic.StoreInt32(&tcpProbeInterval, seconds)
+}
+
+func setTcpProbe(fd int) {
+	interval := int(atomic.LoadInt32(&tcpProbeInterval))
+	if interval <= 0 {
+		return
+	}
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1)
+	if err == nil {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, interval)
+	}
+	if err == nil {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, interval)
+	}
+	if err == nil {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 3)
+	}
+	if err != nil {
+		logrus.Warn("failed to enable tcp probe: ", err)
+	}
+}
+
 func getFd(network v2rayNet.Network, ipv6 bool) (fd int, err error) {
 	var af int
 	if !ipv6 {
@@ -0,0 +1,78 @@
+package libcore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	access  sync.Mutex
+	rate    float64
+	buckets map[uint16]*tokenBucket
+}
+
+func (l *rateLimiter) setRate(rate int32) {
+	l.access.Lock()
+	defer l.access.Unlock()
+
+	l.rate = float64(rate)
+	l.buckets = nil
+}
+
+// allow takes a token from the bucket of uid, the bucket holds at most one second of tokens.
+func (l *rateLimiter) allow(uid uint16) bool {
+	l.access.Lock()
+	defer l.access.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+	if l.buckets == nil {
+		l.buckets = map[uint16]*tokenBucket{}
+	}
+	now := time.Now()
+	bucket := l.buckets[uid]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: l.rate, last: now}
+		l.buckets[uid] = bucket
+	} else {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+		if bucket.tokens > l.rate {
+			bucket.tokens = l.rate
+		}
+		bucket.last = now
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// allowDNS takes a token for a query of uid to the DNS router, counting the query if it is dropped.
+func (t *Tun2ray) allowDNS(uid uint16) bool {
+	if t.dnsLimiter.allow(uid) {
+		return true
+	}
+	atomic.AddUint64(&t.dnsDropped, 1)
+	logrus.Debugf("[DNS] query from uid %d dropped by rate limit", uid)
+	return false
+}
+
+// SetDNSRateLimit caps the DNS queries per second of each uid in the dns-in path, 0 disables the cap.
+func (t *Tun2ray) SetDNSRateLimit(queriesPerSecond int32) {
+	t.dnsLimiter.setRate(queriesPerSecond)
+}
+
+// GetDNSDropped returns the number of DNS queries dropped by the rate limit.
+func (t *Tun2ray) GetDNSDropped() int64 {
+	return int64(atomic.LoadUint64(&t.dnsDropped))
+}
@@ -0,0 +1,217 @@
+package libcore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+// A UDP recording is a sequence of records with big-endian integers:
+//
+//	int64   nanoseconds since the recording started
+//	uint8   direction, 0 for datagrams from the app and 1 for datagrams to the app
+//	uint8   length of the source address, then the source as "ip:port"
+//	uint8   length of the destination address, then the destination as "ip:port"
+//	uint16  length of the datagram, then the datagram
+
+const (
+	udpRecordUplink byte = iota
+	udpRecordDownlink
+)
+
+type udpRecorder struct {
+	access sync.Mutex
+	target string
+	file   *os.File
+	start  time.Time
+}
+
+// StartUdpRecording records the datagrams of the UDP sessions whose app address or destination is
+// the target "ip:port" to the file at path, replacing a running recording. It only works in debug
+// mode.
+func (t *Tun2ray) StartUdpRecording(target string, path string) error {
+	if !t.debug {
+		return newError("UDP recording requires debug mode")
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return newError("failed to create UDP recording").Base(err)
+	}
+	t.access.Lock()
+	old := t.udpRecorder
+	t.udpRecorder = &udpRecorder{
+		target: target,
+		file:   file,
+		start:  time.Now(),
+	}
+	t.access.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+func (t *Tun2ray) StopUdpRecording() {
+	t.access.Lock()
+	recorder := t.udpRecorder
+	t.udpRecorder = nil
+	t.access.Unlock()
+	if recorder != nil {
+		recorder.close()
+	}
+}
+
+func (t *Tun2ray) recordUDP(direction byte, source v2rayNet.Destination, destination v2rayNet.Destination, data []byte) {
+	if !t.debug {
+		return
+	}
+	t.access.RLock()
+	recorder := t.udpRecorder
+	t.access.RUnlock()
+	if recorder == nil {
+		return
+	}
+	sourceAddr, destinationAddr := source.NetAddr(), destination.NetAddr()
+	if recorder.target != sourceAddr && recorder.target != destinationAddr {
+		return
+	}
+	recorder.write(direction, sourceAddr, destinationAddr, data)
+}
+
+func (r *udpRecorder) write(direction byte, source string, destination string, data []byte) {
+	record := make([]byte, 0, 8+1+1+len(source)+1+len(destination)+2+len(data))
+	record = appendUint64(record, uint64(time.Since(r.start)))
+	record = append(record, direction, byte(len(source)))
+	record = append(record, source...)
+	record = append(record, byte(len(destination)))
+	record = append(record, destination...)
+	record = append(record, byte(len(data)>>8), byte(len(data)))
+	record = append(record, data...)
+
+	r.access.Lock()
+	defer r.access.Unlock()
+	if r.file == nil {
+		return
+	}
+	if _, err := r.file.Write(record); err != nil {
+		logrus.Warn("failed to write UDP recording: ", err)
+	}
+}
+
+func (r *udpRecorder) close() {
+	r.access.Lock()
+	defer r.access.Unlock()
+	closeIgnore(r.file)
+	r.file = nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// ReplayUDP feeds the datagrams recorded from apps back through the handler with their original
+// timing, as if the apps sent them again. Datagrams written back are counted and discarded. It
+// only works in debug mode and returns when the last datagram was fed.
+func (t *Tun2ray) ReplayUDP(path string) error {
+	if !t.debug {
+		return newError("UDP replay requires debug mode")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return newError("failed to open UDP recording").Base(err)
+	}
+	defer file.Close()
+
+	var replies, datagrams int
+	var repliesAccess sync.Mutex
+	writeBack := func(data []byte, addr *net.UDPAddr) (int, error) {
+		repliesAccess.Lock()
+		replies++
+		repliesAccess.Unlock()
+		logrus.Debugf("[UDP] replay: %d bytes back from %v", len(data), addr)
+		return len(data), nil
+	}
+
+	reader := bufio.NewReader(file)
+	start := time.Now()
+	for {
+		offset, direction, source, destination, data, err := readUdpRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return newError("invalid UDP recording").Base(err)
+		}
+		if direction != udpRecordUplink {
+			continue
+		}
+		if wait := offset - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+		datagrams++
+		go t.NewPacket(source, destination, data, writeBack, nopCloser{})
+	}
+
+	repliesAccess.Lock()
+	logrus.Infof("[UDP] replayed %d datagrams, %d replies so far", datagrams, replies)
+	repliesAccess.Unlock()
+	return nil
+}
+
+func readUdpRecord(reader *bufio.Reader) (offset time.Duration, direction byte, source v2rayNet.Destination, destination v2rayNet.Destination, data []byte, err error) {
+	var header [9]byte
+	if _, err = io.ReadFull(reader, header[:]); err != nil {
+		return
+	}
+	offset = time.Duration(binary.BigEndian.Uint64(header[:8]))
+	direction = header[8]
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	if source, err = readUdpRecordAddr(reader); err != nil {
+		return
+	}
+	if destination, err = readUdpRecordAddr(reader); err != nil {
+		return
+	}
+	var length [2]byte
+	if _, err = io.ReadFull(reader, length[:]); err != nil {
+		return
+	}
+	data = make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(reader, data)
+	return
+}
+
+func readUdpRecordAddr(reader *bufio.Reader) (v2rayNet.Destination, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return v2rayNet.Destination{}, err
+	}
+	address := make([]byte, length)
+	if _, err = io.ReadFull(reader, address); err != nil {
+		return v2rayNet.Destination{}, err
+	}
+	addr, err := net.ResolveUDPAddr("udp", string(address))
+	if err != nil {
+		return v2rayNet.Destination{}, err
+	}
+	return v2rayNet.DestinationFromAddr(addr), nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,28 @@
+package libcore
+
+import (
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+// ErrorListener is notified when a connection or the first packet of a UDP session can't be
+// forwarded. Network is "tcp" or "udp".
+type ErrorListener interface {
+	OnError(network string, destination string, uid int32, message string)
+}
+
+func (t *Tun2ray) SetErrorListener(listener ErrorListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.errorListener = listener
+}
+
+func (t *Tun2ray) reportError(destination v2rayNet.Destination, uid uint16, err error) {
+	t.access.RLock()
+	listener := t.errorListener
+	t.access.RUnlock()
+	if listener == nil {
+		return
+	}
+	listener.OnError(destination.Network.SystemString(), destination.NetAddr(), int32(uid), err.Error())
+}
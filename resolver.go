@@ -0,0 +1,77 @@
+package libcore
+
+import (
+	"context"
+	"net"
+
+	v2rayDns "github.com/v2fly/v2ray-core/v4/features/dns"
+	"github.com/v2fly/v2ray-core/v4/transport/internet"
+)
+
+// resolverSet holds the lookups of the protected dialers, swapped as a whole by RefreshResolvers.
+type resolverSet struct {
+	lookupIP     func(domain string) ([]net.IP, error)
+	systemLookup func(domain string) ([]net.IP, error)
+}
+
+func (t *Tun2ray) newResolverSet() *resolverSet {
+	dc := t.v2ray.dnsClient
+	nc := &net.Resolver{PreferGo: false}
+	systemLookup := func(domain string) ([]net.IP, error) {
+		ips, err := nc.LookupIP(context.Background(), "ip", domain)
+		t.onDNSQuery(domain, DNSSourceSystem, ips, err)
+		return ips, err
+	}
+	set := &resolverSet{systemLookup: systemLookup}
+
+	if c, ok := dc.(v2rayDns.ClientWithIPOption); ok {
+		if t.fakedns {
+			c.SetFakeDNSOption(true)
+			ips, err := dc.LookupIP("placeholder")
+			t.onDNSQuery("placeholder", DNSSourceFake, ips, err)
+		}
+		set.lookupIP = func(domain string) ([]net.IP, error) {
+			return t.resolveIP(domain, func() ([]net.IP, error) {
+				c.SetFakeDNSOption(false) // Skip FakeDNS
+				ips, err := dc.LookupIP(domain)
+				t.onDNSQuery(domain, DNSSourceReal, ips, err)
+				return ips, err
+			}, systemLookup)
+		}
+	} else {
+		set.lookupIP = func(domain string) ([]net.IP, error) {
+			return t.resolveIP(domain, func() ([]net.IP, error) {
+				ips, err := dc.LookupIP(domain)
+				t.onDNSQuery(domain, DNSSourceReal, ips, err)
+				return ips, err
+			}, systemLookup)
+		}
+	}
+	return set
+}
+
+func (t *Tun2ray) resolverSet() *resolverSet {
+	return t.resolvers.Load().(*resolverSet)
+}
+
+// bindResolvers installs the protected dialers. They load the current resolver set on every
+// dial, so it can be replaced while dials are in flight.
+func (t *Tun2ray) bindResolvers() {
+	t.resolvers.Store(t.newResolverSet())
+	internet.UseAlternativeSystemDialer(&protectedDialer{
+		resolver: func(domain string) ([]net.IP, error) {
+			return t.resolverSet().lookupIP(domain)
+		},
+	})
+	internet.UseAlternativeSystemDNSDialer(&protectedDialer{
+		resolver: func(domain string) ([]net.IP, error) {
+			return t.resolverSet().systemLookup(domain)
+		},
+	})
+}
+
+// RefreshResolvers rebuilds the lookups of the protected dialers from the current DNS client of
+// the v2ray instance and the fakedns setting. Dials already resolving finish with the old ones.
+func (t *Tun2ray) RefreshResolvers() {
+	t.resolvers.Store(t.newResolverSet())
+}
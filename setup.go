@@ -0,0 +1,43 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// connSetupWait is how long a TCP connection waits for a setup slot before it is rejected.
+const connSetupWait = time.Second
+
+// acquireSetup takes one of the maxConnSetups slots bounding the TCP connections being set up
+// concurrently, waiting up to connSetupWait for one. It returns the func releasing the slot,
+// which may be called more than once, or nil if the connection is rejected.
+func (t *Tun2ray) acquireSetup() func() {
+	if t.setupSlots == nil {
+		return func() {}
+	}
+	select {
+	case t.setupSlots <- struct{}{}:
+	default:
+		timer := time.NewTimer(connSetupWait)
+		defer timer.Stop()
+		select {
+		case t.setupSlots <- struct{}{}:
+		case <-timer.C:
+			atomic.AddUint64(&t.setupRejected, 1)
+			return nil
+		}
+	}
+	var released bool
+	return func() {
+		if !released {
+			released = true
+			<-t.setupSlots
+		}
+	}
+}
+
+// GetSetupRejected returns the number of TCP connections rejected for waiting too long on the
+// concurrent setup limit.
+func (t *Tun2ray) GetSetupRejected() int64 {
+	return int64(atomic.LoadUint64(&t.setupRejected))
+}
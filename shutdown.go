@@ -0,0 +1,54 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownTimeout bounds how long Close waits for the sessions to return.
+const shutdownTimeout = 5 * time.Second
+
+// enterSession registers a NewConnection or NewPacket call, or returns false once Close has begun.
+func (t *Tun2ray) enterSession() bool {
+	t.sessionAccess.Lock()
+	defer t.sessionAccess.Unlock()
+
+	if atomic.LoadInt32(&t.closed) != 0 {
+		return false
+	}
+	t.sessions.Add(1)
+	return true
+}
+
+// waitSessions waits for the registered calls to return, or returns false after the timeout.
+func (t *Tun2ray) waitSessions(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.sessions.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		logrus.Warn("sessions still running after ", timeout, ", closing the device anyway")
+		return false
+	}
+}
+
+// closeAll refuses new sessions and returns the closers of the active ones.
+func (t *connTable) closeAll() []interface{} {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.closed = true
+	closers := make([]interface{}, 0, len(t.conns))
+	for _, c := range t.conns {
+		closers = append(closers, c.closer)
+	}
+	return closers
+}
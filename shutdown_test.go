@@ -0,0 +1,88 @@
+package libcore
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+)
+
+type recordingDev struct {
+	access           sync.Mutex
+	closed           bool
+	writesAfterClose int
+}
+
+func (d *recordingDev) Close() error {
+	d.access.Lock()
+	defer d.access.Unlock()
+
+	d.closed = true
+	return nil
+}
+
+func (d *recordingDev) write() {
+	d.access.Lock()
+	defer d.access.Unlock()
+
+	if d.closed {
+		d.writesAfterClose++
+	}
+}
+
+func TestCloseOrder(t *testing.T) {
+	dev := &recordingDev{}
+	tun := &Tun2ray{dev: dev, udpTable: &natTable{}}
+	destination := v2rayNet.TCPDestination(v2rayNet.ParseAddress("1.1.1.1"), 443)
+
+	for i := 0; i < 8; i++ {
+		if !tun.enterSession() {
+			t.Fatal("session refused before close")
+		}
+		local, remote := net.Pipe()
+		info := &connInfo{
+			network:     "tcp",
+			source:      v2rayNet.TCPDestination(v2rayNet.ParseAddress("172.19.0.2"), v2rayNet.Port(40000+i)),
+			destination: destination,
+			closer:      local,
+		}
+		if !tun.connections.add(info) {
+			t.Fatal("session rejected before close")
+		}
+		go func() {
+			defer tun.sessions.Done()
+			defer tun.connections.remove(info)
+
+			_, _ = remote.Read(make([]byte, 1))
+			// the session writes back once its connection is closed
+			dev.write()
+		}()
+	}
+
+	tun.Close()
+
+	if !dev.closed {
+		t.Fatal("device not closed")
+	}
+	if dev.writesAfterClose != 0 {
+		t.Fatalf("%d writes after the device was closed", dev.writesAfterClose)
+	}
+	if tun.enterSession() {
+		t.Fatal("session accepted after close")
+	}
+	if tun.connections.add(&connInfo{network: "tcp", source: destination, destination: destination}) {
+		t.Fatal("session registered after close")
+	}
+
+	local, remote := net.Pipe()
+	tun.NewConnection(destination, destination, local)
+	if _, err := remote.Write([]byte{0}); err == nil {
+		t.Fatal("connection not closed after close")
+	}
+	closer := &closeCounter{}
+	tun.NewPacket(destination, destination, []byte{0}, nil, closer)
+	if closer.closed != 1 {
+		t.Fatal("packet closer not closed after close")
+	}
+}
@@ -0,0 +1,174 @@
+package libcore
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/v2fly/v2ray-core/v4/common/buf"
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+	"github.com/v2fly/v2ray-core/v4/common/protocol/http"
+	"github.com/v2fly/v2ray-core/v4/common/protocol/quic"
+	"github.com/v2fly/v2ray-core/v4/common/protocol/tls"
+	"github.com/v2fly/v2ray-core/v4/common/session"
+)
+
+const (
+	SniffMissProceed int32 = iota
+	SniffMissRoute
+	SniffMissLog
+)
+
+// defaultSniffTimeout is the wait for the first client data of a TCP connection if
+// SetSniffTimeout wasn't called.
+const defaultSniffTimeout = 300 * time.Millisecond
+
+// SetSniffingNetworks enables sniffing of TCP (http, tls) and UDP (quic) independently, both
+// default to the sniffing flag of NewTun2ray.
+func (t *Tun2ray) SetSniffingNetworks(tcp bool, udp bool) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.sniffingTCP = tcp
+	t.sniffingUDP = udp
+}
+
+func (t *Tun2ray) sniffingFor(udp bool) bool {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	if udp {
+		return t.sniffingUDP
+	}
+	return t.sniffingTCP
+}
+
+// SetSniffMissPolicy decides what happens to flows that sniffing can't identify: proceed to the
+// raw destination, route them to the outbound tag, or log them and proceed.
+func (t *Tun2ray) SetSniffMissPolicy(policy int32, tag string) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.sniffMissPolicy = policy
+	t.sniffMissTag = tag
+}
+
+// SetSniffTimeout sets how long a TCP connection waits for its first client data to be sniffed
+// while a sniff miss policy or a connection filter is set, 0 restores the default of 300ms. The
+// wait delays protocols where the server speaks first, like SMTP, FTP or SSH, by its full length.
+// Connections that send nothing in time proceed unsniffed and are not treated as misses.
+func (t *Tun2ray) SetSniffTimeout(milliseconds int32) {
+	atomic.StoreInt32(&t.sniffTimeout, milliseconds)
+}
+
+func (t *Tun2ray) getSniffTimeout() time.Duration {
+	if timeout := atomic.LoadInt32(&t.sniffTimeout); timeout > 0 {
+		return time.Duration(timeout) * time.Millisecond
+	}
+	return defaultSniffTimeout
+}
+
+func (t *Tun2ray) getSniffMissPolicy() (int32, string) {
+	t.access.RLock()
+	defer t.access.RUnlock()
+
+	return t.sniffMissPolicy, t.sniffMissTag
+}
+
+func (t *Tun2ray) onSniffMiss(ctx context.Context, network string, policy int32, tag string, source v2rayNet.Destination, destination v2rayNet.Destination) context.Context {
+	switch policy {
+	case SniffMissRoute:
+		logrus.Debugf("[%s] sniffing missed, routing to %s: %s ==> %s", network, tag, source.NetAddr(), destination.NetAddr())
+		return session.SetForcedOutboundTagToContext(ctx, tag)
+	case SniffMissLog:
+		logrus.Infof("[%s] sniffing missed: %s ==> %s", network, source.NetAddr(), destination.NetAddr())
+	}
+	return ctx
+}
+
+// sniffTCP waits briefly for the first payload of conn when the sniff miss policy or the
+// connection filter needs it, and applies the policy to a payload that isn't identified. The
+// returned conn replays the payload read for sniffing, the domain is empty if none was sniffed.
+func (t *Tun2ray) sniffTCP(ctx context.Context, source v2rayNet.Destination, destination v2rayNet.Destination, conn net.Conn) (context.Context, net.Conn, string) {
+	policy, tag := t.getSniffMissPolicy()
+	if policy == SniffMissProceed && t.getConnectionFilter() == nil {
+		return ctx, conn, ""
+	}
+	sc := newSniffConn(conn)
+	protocol, domain, ok := sc.sniff(t.getSniffTimeout())
+	if ok && protocol == "" {
+		ctx = t.onSniffMiss(ctx, "TCP", policy, tag, source, destination)
+	}
+	return ctx, sc, domain
+}
+
+func (t *Tun2ray) sniffUDP(ctx context.Context, source v2rayNet.Destination, destination v2rayNet.Destination, data []byte) (context.Context, string) {
+	policy, tag := t.getSniffMissPolicy()
+	if policy == SniffMissProceed && t.getConnectionFilter() == nil {
+		return ctx, ""
+	}
+	header, err := quic.SniffQUIC(data)
+	if err != nil {
+		return t.onSniffMiss(ctx, "UDP", policy, tag, source, destination), ""
+	}
+	return ctx, header.Domain()
+}
+
+type sniffConn struct {
+	net.Conn
+	ready  chan struct{}
+	buffer []byte
+	err    error
+}
+
+func newSniffConn(conn net.Conn) *sniffConn {
+	c := &sniffConn{
+		Conn:  conn,
+		ready: make(chan struct{}),
+	}
+	go func() {
+		buffer := make([]byte, buf.Size)
+		n, err := conn.Read(buffer)
+		c.buffer, c.err = buffer[:n], err
+		close(c.ready)
+	}()
+	return c
+}
+
+// sniff returns the sniffed protocol and domain of the first payload, which are empty if it is
+// neither HTTP nor TLS. ok is false if no payload arrived within the timeout.
+func (c *sniffConn) sniff(timeout time.Duration) (protocol string, domain string, ok bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.ready:
+	case <-timer.C:
+		return
+	}
+	ok = true
+	if header, err := tls.SniffTLS(c.buffer); err == nil {
+		return header.Protocol(), header.Domain()
+	}
+	if header, err := http.SniffHTTP(c.buffer); err == nil {
+		return header.Protocol(), header.Domain()
+	}
+	return
+}
+
+func (c *sniffConn) Read(b []byte) (n int, err error) {
+	if c.ready != nil {
+		<-c.ready
+		if len(c.buffer) > 0 {
+			n = copy(b, c.buffer)
+			c.buffer = c.buffer[n:]
+			return n, nil
+		}
+		c.ready = nil
+		if c.err != nil {
+			return 0, c.err
+		}
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,63 @@
+package libcore
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+	"golang.org/x/sys/unix"
+)
+
+// SetUdpSourcePortPreservation makes outbounds that dial the UDP destination directly bind the
+// app's source port. Other outbounds, or a port already in use, keep an ephemeral port.
+func (t *Tun2ray) SetUdpSourcePortPreservation(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&t.preserveUdpPort, value)
+}
+
+type sourcePortKey struct{}
+
+// sourcePort is the source port to bind when dialing the original destination of a UDP session.
+type sourcePort struct {
+	port        uint16
+	destination v2rayNet.Destination
+}
+
+func (t *Tun2ray) withSourcePort(ctx context.Context, source v2rayNet.Destination, destination v2rayNet.Destination) context.Context {
+	if atomic.LoadInt32(&t.preserveUdpPort) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, sourcePortKey{}, &sourcePort{uint16(source.Port), destination})
+}
+
+func sourcePortFromContext(ctx context.Context) *sourcePort {
+	if ctx == nil {
+		return nil
+	}
+	p, _ := ctx.Value(sourcePortKey{}).(*sourcePort)
+	return p
+}
+
+// bind binds fd to the source port if it is about to connect to the session's destination.
+func (p *sourcePort) bind(fd int, ipv6 bool, destination v2rayNet.Destination) {
+	if destination.Network != v2rayNet.Network_UDP {
+		return
+	}
+	if destination.Port != p.destination.Port || !destination.Address.IP().Equal(p.destination.Address.IP()) {
+		logrus.Debug("source port preservation unsupported by outbound to ", destination.NetAddr())
+		return
+	}
+	var sockaddr unix.Sockaddr
+	if ipv6 {
+		sockaddr = &unix.SockaddrInet6{Port: int(p.port)}
+	} else {
+		sockaddr = &unix.SockaddrInet4{Port: int(p.port)}
+	}
+	if err := unix.Bind(fd, sockaddr); err != nil {
+		logrus.Warn("failed to preserve source port ", p.port, ": ", err)
+	}
+}
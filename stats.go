@@ -1,8 +1,12 @@
 package libcore
 
 import (
+	"bytes"
+	"encoding/binary"
 	"net"
 	"sync/atomic"
+
+	"github.com/v2fly/v2ray-core/v4/common/session"
 )
 
 type AppStats struct {
@@ -17,6 +21,14 @@ type AppStats struct {
 	UplinkTotal   int64
 	DownlinkTotal int64
 
+	ForegroundBytes int64
+	BackgroundBytes int64
+
+	DnsQueries int32
+
+	// FirstByteMs is the average time to first byte of the app's sessions.
+	FirstByteMs int32
+
 	DeactivateAt int32
 }
 
@@ -31,7 +43,51 @@ type appStats struct {
 	uplinkTotal   uint64
 	downlinkTotal uint64
 
-	deactivateAt int64
+	foregroundBytes uint64
+	backgroundBytes uint64
+	firstByteSum    uint64
+
+	deactivateAt   int64
+	firstByteCount uint32
+	dnsQueries     uint32
+}
+
+// statusBytes returns the counter crediting the traffic of a connection by the app status
+// known when it started.
+func (s *appStats) statusBytes(inbound *session.Inbound) *uint64 {
+	for _, status := range inbound.AppStatus {
+		if status == appStatusForeground {
+			return &s.foregroundBytes
+		}
+	}
+	return &s.backgroundBytes
+}
+
+// SystemTrafficUid is the reserved uid the core's own traffic is accounted to.
+const SystemTrafficUid int32 = 0xFFFF
+
+// statsUid returns the uid a connection is accounted to.
+func statsUid(uid uint16, self bool) uint16 {
+	if self {
+		return uint16(SystemTrafficUid)
+	}
+	return uid
+}
+
+func (t *Tun2ray) appStatsFor(uid uint16) *appStats {
+	t.access.RLock()
+	stats := t.appStats[uid]
+	t.access.RUnlock()
+	if stats == nil {
+		t.access.Lock()
+		stats = t.appStats[uid]
+		if stats == nil {
+			stats = &appStats{}
+			t.appStats[uid] = stats
+		}
+		t.access.Unlock()
+	}
+	return stats
 }
 
 type TrafficListener interface {
@@ -54,6 +110,11 @@ func (t *Tun2ray) ResetAppTraffics() {
 		atomic.StoreUint64(&stat.downlink, 0)
 		atomic.StoreUint64(&stat.uplinkTotal, 0)
 		atomic.StoreUint64(&stat.downlinkTotal, 0)
+		atomic.StoreUint64(&stat.foregroundBytes, 0)
+		atomic.StoreUint64(&stat.backgroundBytes, 0)
+		atomic.StoreUint64(&stat.firstByteSum, 0)
+		atomic.StoreUint32(&stat.firstByteCount, 0)
+		atomic.StoreUint32(&stat.dnsQueries, 0)
 		if stat.tcpConn+stat.udpConn == 0 {
 			toDel = append(toDel, uid)
 		}
@@ -69,11 +130,9 @@ func (t *Tun2ray) ResetAppTraffics() {
 
 }
 
-func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
-	if !t.trafficStats {
-		return nil
-	}
-
+// gatherAppTraffics exports the stats of every app, moving the traffic since the last read into
+// the totals.
+func (t *Tun2ray) gatherAppTraffics() []*AppStats {
 	var stats []*AppStats
 	t.access.RLock()
 	for uid, stat := range t.appStats {
@@ -84,6 +143,13 @@ func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
 			TcpConnTotal: int32(stat.tcpConnTotal),
 			UdpConnTotal: int32(stat.udpConnTotal),
 			DeactivateAt: int32(stat.deactivateAt),
+
+			ForegroundBytes: int64(atomic.LoadUint64(&stat.foregroundBytes)),
+			BackgroundBytes: int64(atomic.LoadUint64(&stat.backgroundBytes)),
+			DnsQueries:      int32(atomic.LoadUint32(&stat.dnsQueries)),
+		}
+		if count := atomic.LoadUint32(&stat.firstByteCount); count > 0 {
+			export.FirstByteMs = int32(atomic.LoadUint64(&stat.firstByteSum) / uint64(count))
 		}
 
 		uplink := atomic.SwapUint64(&stat.uplink, 0)
@@ -99,42 +165,105 @@ func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
 		stats = append(stats, export)
 	}
 	t.access.RUnlock()
+	return stats
+}
 
-	for _, stat := range stats {
+func (t *Tun2ray) ReadAppTraffics(listener TrafficListener) error {
+	if !t.trafficStats {
+		return nil
+	}
+
+	for _, stat := range t.gatherAppTraffics() {
 		listener.UpdateStats(stat)
 	}
 
 	return nil
 }
 
+// appStatsBinaryVersion is the first byte of ReadAppTrafficsBinary.
+const appStatsBinaryVersion = 1
+
+// ReadAppTrafficsBinary reads the same stats as ReadAppTraffics in one call. The blob is the
+// version byte, a big endian uint32 count, then the AppStats fields of each app in declaration
+// order, big endian.
+func (t *Tun2ray) ReadAppTrafficsBinary() ([]byte, error) {
+	if !t.trafficStats {
+		return nil, nil
+	}
+
+	stats := t.gatherAppTraffics()
+	buffer := bytes.NewBuffer(make([]byte, 0, 5+len(stats)*binary.Size(AppStats{})))
+	buffer.WriteByte(appStatsBinaryVersion)
+	if err := binary.Write(buffer, binary.BigEndian, uint32(len(stats))); err != nil {
+		return nil, err
+	}
+	for _, stat := range stats {
+		if err := binary.Write(buffer, binary.BigEndian, stat); err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// TransportTraffic is the traffic of all TCP connections and UDP sessions since start.
+type TransportTraffic struct {
+	TcpUplink   int64
+	TcpDownlink int64
+	UdpUplink   int64
+	UdpDownlink int64
+}
+
+func (t *Tun2ray) TotalTrafficByTransport() *TransportTraffic {
+	return &TransportTraffic{
+		TcpUplink:   int64(atomic.LoadUint64(&t.tcpUplink)),
+		TcpDownlink: int64(atomic.LoadUint64(&t.tcpDownlink)),
+		UdpUplink:   int64(atomic.LoadUint64(&t.udpUplink)),
+		UdpDownlink: int64(atomic.LoadUint64(&t.udpDownlink)),
+	}
+}
+
+// addStats credits n bytes to counter and, if set, to the app status counter.
+func addStats(counter *uint64, status *uint64, n int) {
+	atomic.AddUint64(counter, uint64(n))
+	if status != nil {
+		atomic.AddUint64(status, uint64(n))
+	}
+}
+
+// statsConn counts the bytes of a connection on the tun side, so the counts are application
+// payload for every outbound: transport framing, padding and TLS overhead happen past the
+// dispatcher and are never seen here.
 type statsConn struct {
 	net.Conn
 	uplink   *uint64
 	downlink *uint64
+	status   *uint64
 }
 
 func (c *statsConn) Read(b []byte) (n int, err error) {
 	n, err = c.Conn.Read(b)
-	defer atomic.AddUint64(c.uplink, uint64(n))
+	defer addStats(c.uplink, c.status, n)
 	return
 }
 
 func (c *statsConn) Write(b []byte) (n int, err error) {
 	n, err = c.Conn.Write(b)
-	defer atomic.AddUint64(c.downlink, uint64(n))
+	defer addStats(c.downlink, c.status, n)
 	return
 }
 
+// statsPacketConn counts the UDP payload of a session on the tun side, like statsConn.
 type statsPacketConn struct {
 	packetConn
 	uplink   *uint64
 	downlink *uint64
+	status   *uint64
 }
 
 func (c statsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	n, addr, err = c.packetConn.ReadFrom(p)
 	if err == nil {
-		atomic.AddUint64(c.downlink, uint64(n))
+		addStats(c.downlink, c.status, n)
 	}
 	return
 }
@@ -142,7 +271,7 @@ func (c statsPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 func (c statsPacketConn) readFrom() (p []byte, addr net.Addr, err error) {
 	p, addr, err = c.packetConn.readFrom()
 	if err == nil {
-		atomic.AddUint64(c.downlink, uint64(len(p)))
+		addStats(c.downlink, c.status, len(p))
 	}
 	return
 }
@@ -150,7 +279,21 @@ func (c statsPacketConn) readFrom() (p []byte, addr net.Addr, err error) {
 func (c statsPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	n, err = c.packetConn.WriteTo(p, addr)
 	if err == nil {
-		atomic.AddUint64(c.uplink, uint64(n))
+		addStats(c.uplink, c.status, n)
+	}
+	return
+}
+
+// dnsQueryConn counts the queries an app sends to the DNS hijack address.
+type dnsQueryConn struct {
+	packetConn
+	queries *uint32
+}
+
+func (c dnsQueryConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	n, err = c.packetConn.WriteTo(p, addr)
+	if err == nil {
+		atomic.AddUint32(c.queries, 1)
 	}
 	return
 }
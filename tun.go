@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,29 +20,107 @@ import (
 	"github.com/v2fly/v2ray-core/v4/common/buf"
 	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
 	"github.com/v2fly/v2ray-core/v4/common/session"
-	v2rayDns "github.com/v2fly/v2ray-core/v4/features/dns"
 	"github.com/v2fly/v2ray-core/v4/transport"
-	"github.com/v2fly/v2ray-core/v4/transport/internet"
 	"github.com/v2fly/v2ray-core/v4/transport/pipe"
 )
 
 var _ tun.Handler = (*Tun2ray)(nil)
 
 type Tun2ray struct {
+	// 64-bit atomic counters come first to keep them aligned on 32-bit platforms
+	dnsDropped    uint64
+	familyDropped uint64
+	udpTruncated  uint64
+	natDropped    uint64
+	resolverDials uint64
+	tcpUplink     uint64
+	tcpDownlink   uint64
+	udpUplink     uint64
+	udpDownlink   uint64
+	setupRejected uint64
+
 	access              sync.RWMutex
 	dev                 tun.Tun
-	router              string
+	router              net.IP
 	v2ray               *V2RayInstance
 	udpTable            *natTable
 	fakedns             bool
-	sniffing            bool
+	sniffingTCP         bool
+	sniffingUDP         bool
 	overrideDestination bool
 	debug               bool
 
 	dumpUid      bool
 	trafficStats bool
 	appStats     map[uint16]*appStats
-	pcap         bool
+	pipeLimit    int32
+	setupSlots   chan struct{}
+
+	pauseAccess sync.Mutex
+	paused      int32
+	resumed     chan struct{}
+
+	dnsLimiter rateLimiter
+
+	udpHighWater  int32
+	udpDropPolicy int32
+
+	connections connTable
+
+	sniffMissPolicy int32
+	sniffMissTag    string
+	sniffTimeout    int32
+
+	labelDecider LabelDecider
+	labelStats   map[string]*labelStats
+
+	maxConnLifetime int32
+
+	udpReadErrorThreshold int32
+
+	dnsCache dnsCache
+
+	dialOverride DialOverride
+
+	errorListener ErrorListener
+
+	preserveUdpPort int32
+
+	connectionFilter ConnectionFilter
+
+	maxUdpSessions  int32
+	natFullListener NatFullListener
+
+	impairLatency int32
+	impairLoss    int32
+
+	dnsQueryListener DNSQueryListener
+
+	dnsFailMode int32
+
+	idle         int32
+	idleTimer    *time.Timer
+	idlePeriod   time.Duration
+	idleListener IdleListener
+
+	resolverDialListener ResolverDialListener
+
+	firstTraffic         int32
+	firstTrafficListener FirstTrafficListener
+
+	dnsResponseRewriter DNSResponseRewriter
+
+	resolvers atomic.Value
+
+	uidTags map[uint16]string
+
+	closed         int32
+	deviceListener DeviceListener
+
+	sessionAccess sync.Mutex
+	sessions      sync.WaitGroup
+
+	udpRecorder *udpRecorder
 }
 
 const (
@@ -49,102 +128,190 @@ const (
 	appStatusBackground = "background"
 )
 
-func NewTun2ray(fd int32, mtu int32, v2ray *V2RayInstance, router string, gVisor bool, sniffing bool, overrideDestination bool, fakedns bool, debug bool, dumpUid bool, trafficStats bool, pcap bool) (*Tun2ray, error) {
+func NewTun2ray(fd int32, mtu int32, v2ray *V2RayInstance, router string, gVisor bool, sniffing bool, overrideDestination bool, fakedns bool, debug bool, dumpUid bool, trafficStats bool, pcap bool, queueLength int32, readBuffers int32, pipeLimit int32, maxConnSetups int32) (*Tun2ray, error) {
+	routerIP, err := parseRouter(router)
+	if err != nil {
+		return nil, err
+	}
+	if err := v2ray.ready(); err != nil {
+		return nil, err
+	}
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	} else {
 		logrus.SetLevel(logrus.WarnLevel)
 	}
 	t := &Tun2ray{
-		router:              router,
+		router:              routerIP,
 		v2ray:               v2ray,
 		udpTable:            &natTable{},
-		sniffing:            sniffing,
+		sniffingTCP:         sniffing,
+		sniffingUDP:         sniffing,
 		overrideDestination: overrideDestination,
 		fakedns:             fakedns,
 		debug:               debug,
 		dumpUid:             dumpUid,
 		trafficStats:        trafficStats,
+		pipeLimit:           pipeLimit,
+	}
+	if maxConnSetups > 0 {
+		t.setupSlots = make(chan struct{}, maxConnSetups)
 	}
 
 	if trafficStats {
 		t.appStats = map[uint16]*appStats{}
 	}
-	var err error
 	if gVisor {
 		var pcapFile *os.File
 		if pcap {
-			path := time.Now().UTC().String()
-			path = externalAssetsPath + "/pcap/" + path + ".pcap"
-			err = os.MkdirAll(filepath.Dir(path), 0o755)
+			pcapFile, err = createPcapFile("")
 			if err != nil {
-				return nil, newError("unable to create pcap dir").Base(err)
-			}
-			pcapFile, err = os.Create(path)
-			if err != nil {
-				return nil, newError("unable to create pcap file").Base(err)
+				return nil, err
 			}
 		}
 
-		t.dev, err = gvisor.New(fd, mtu, t, gvisor.DefaultNIC, pcap, pcapFile, math.MaxUint32, ipv6Mode)
+		t.dev, err = gvisor.New(fd, mtu, t, gvisor.DefaultNIC, pcap, pcapFile, math.MaxUint32, ipv6Mode, queueLength, readBuffers, t.onDeviceClosed)
 	} else {
 		dev := os.NewFile(uintptr(fd), "")
 		if dev == nil {
 			return nil, newError("failed to open TUN file descriptor")
 		}
-		t.dev, err = lwip.New(dev, mtu, t)
+		t.dev, err = lwip.New(dev, mtu, t, t.onDeviceClosed)
 	}
 	if err != nil {
 		return nil, err
 	}
 
-	dc := v2ray.dnsClient
+	t.bindResolvers()
 
-	if c, ok := dc.(v2rayDns.ClientWithIPOption); ok {
-		if fakedns {
-			c.SetFakeDNSOption(true)
-			_, _ = dc.LookupIP("placeholder")
-		}
-		internet.UseAlternativeSystemDialer(&protectedDialer{
-			resolver: func(domain string) ([]net.IP, error) {
-				c.SetFakeDNSOption(false) // Skip FakeDNS
-				return dc.LookupIP(domain)
-			},
-		})
-	} else {
-		internet.UseAlternativeSystemDialer(&protectedDialer{
-			resolver: func(domain string) ([]net.IP, error) {
-				return dc.LookupIP(domain)
-			},
-		})
+	net.DefaultResolver.Dial = t.dialDNS
+	return t, nil
+}
+
+// createPcapFile creates the capture file at path, or at a timestamped path in the pcap assets
+// directory if path is empty.
+func createPcapFile(path string) (*os.File, error) {
+	if path == "" {
+		path = externalAssetsPath + "/pcap/" + time.Now().UTC().String() + ".pcap"
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, newError("unable to create pcap dir").Base(err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, newError("unable to create pcap file").Base(err)
+	}
+	return file, nil
+}
+
+// StartPcap starts capturing packets to path, or to a new file in the pcap assets directory if
+// path is empty. Only the gVisor stack supports capture, lwip has no link endpoint to hook.
+func (t *Tun2ray) StartPcap(path string) error {
+	dev, ok := t.dev.(*gvisor.GVisor)
+	if !ok {
+		return newError("pcap requires the gVisor stack")
+	}
+	file, err := createPcapFile(path)
+	if err != nil {
+		return err
+	}
+	if err = dev.StartPcap(file); err != nil {
+		closeIgnore(file)
+		return err
 	}
+	return nil
+}
 
-	nc := &net.Resolver{PreferGo: false}
-	internet.UseAlternativeSystemDNSDialer(&protectedDialer{
-		resolver: func(domain string) ([]net.IP, error) {
-			return nc.LookupIP(context.Background(), "ip", domain)
-		},
-	})
+// StopPcap stops the capture and closes the file.
+func (t *Tun2ray) StopPcap() {
+	if dev, ok := t.dev.(*gvisor.GVisor); ok {
+		dev.StopPcap()
+	}
+}
 
-	net.DefaultResolver.Dial = t.dialDNS
-	return t, nil
+// parseRouter parses the DNS hijack address, which may be bracketed or carry a port. Empty
+// disables the hijack.
+func parseRouter(router string) (net.IP, error) {
+	router = strings.TrimSpace(router)
+	if router == "" {
+		return nil, nil
+	}
+	if host, _, err := net.SplitHostPort(router); err == nil {
+		router = host
+	}
+	ip := net.ParseIP(strings.Trim(router, "[]"))
+	if ip == nil {
+		return nil, newError("invalid router address: ", router)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, nil
 }
 
+func (t *Tun2ray) isRouter(destination v2rayNet.Destination) bool {
+	return t.router != nil && destination.Address.Family().IsIP() && destination.Address.IP().Equal(t.router)
+}
+
+// Close tears the tunnel down in order: new connections and packets are refused, the active
+// sessions are closed and get up to shutdownTimeout to return, then the device is closed. No
+// session writes back to a closed device unless the wait times out.
 func (t *Tun2ray) Close() {
+	t.sessionAccess.Lock()
+	atomic.StoreInt32(&t.closed, 1)
+	t.sessionAccess.Unlock()
+
+	net.DefaultResolver.Dial = nil
+	t.Resume()
+	closeIgnore(t.connections.closeAll()...)
+	t.waitSessions(shutdownTimeout)
+
 	t.access.Lock()
 	defer t.access.Unlock()
 
-	net.DefaultResolver.Dial = nil
+	if t.idleTimer != nil {
+		t.idleTimer.Stop()
+		t.idleTimer = nil
+	}
+	if t.udpRecorder != nil {
+		t.udpRecorder.close()
+		t.udpRecorder = nil
+	}
 	closeIgnore(t.dev)
 }
 
 func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNet.Destination, conn net.Conn) {
+	if !t.enterSession() {
+		closeIgnore(conn)
+		return
+	}
+	defer t.sessions.Done()
+
+	if t.isPaused() {
+		closeIgnore(conn)
+		return
+	}
+	if t.dropFamily(destination) {
+		closeIgnore(conn)
+		return
+	}
+	t.wake()
+	releaseSetup := t.acquireSetup()
+	if releaseSetup == nil {
+		logrus.Debugf("[TCP] setup limit reached: %s ==> %s", source.NetAddr(), destination.NetAddr())
+		closeIgnore(conn)
+		return
+	}
+	defer releaseSetup()
+	conn = &pausableConn{conn, t}
+
 	inbound := &session.Inbound{
 		Source: source,
 		Tag:    "socks",
 	}
 
-	isDns := destination.Address.String() == t.router
+	isDns := t.isRouter(destination)
 	if isDns {
 		inbound.Tag = "dns-in"
 	}
@@ -153,7 +320,7 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 	var self bool
 
 	if t.dumpUid || t.trafficStats {
-		u, err := uidDumper.DumpUid(destination.Address.Family().IsIPv6(), false, source.Address.IP().String(), int32(source.Port), destination.Address.IP().String(), int32(destination.Port))
+		u, err := dumpUid(false, source, destination)
 		if err == nil {
 			uid = uint16(u)
 			var info *UidInfo
@@ -175,7 +342,7 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 
 			inbound.Uid = uint32(uid)
 
-			if uid == foregroundUid || uid == foregroundImeUid {
+			if isForeground(uid) {
 				inbound.AppStatus = append(inbound.AppStatus, appStatusForeground)
 			} else {
 				inbound.AppStatus = append(inbound.AppStatus, appStatusBackground)
@@ -186,16 +353,17 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 	ctx := core.WithContext(context.Background(), t.v2ray.core)
 	ctx = session.ContextWithInbound(ctx, inbound)
 
-	if !isDns && (t.sniffing || t.fakedns) {
+	sniffing := t.sniffingFor(false)
+	if !isDns && (sniffing || t.fakedns) {
 		req := session.SniffingRequest{
 			Enabled:      true,
-			MetadataOnly: t.fakedns && !t.sniffing,
+			MetadataOnly: t.fakedns && !sniffing,
 			RouteOnly:    !t.overrideDestination,
 		}
 		if t.fakedns {
 			req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "fakedns")
 		}
-		if t.sniffing {
+		if sniffing {
 			req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "http", "tls")
 		}
 		ctx = session.ContextWithContent(ctx, &session.Content{
@@ -203,19 +371,33 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 		})
 	}
 
-	if t.trafficStats && !self && !isDns {
-		t.access.RLock()
-		stats := t.appStats[uid]
-		t.access.RUnlock()
-		if stats == nil {
-			t.access.Lock()
-			stats = t.appStats[uid]
-			if stats == nil {
-				stats = &appStats{}
-				t.appStats[uid] = stats
-			}
-			t.access.Unlock()
-		}
+	outbound := &outboundTag{}
+
+	info := &connInfo{
+		uid:         uid,
+		network:     "tcp",
+		source:      source,
+		destination: destination,
+		startedAt:   time.Now().Unix(),
+		start:       time.Now(),
+		closer:      conn,
+		outbound:    outbound,
+	}
+	if !t.connections.add(info) {
+		logrus.Debugf("[TCP] rejected by session limits: %s ==> %s", source.NetAddr(), destination.NetAddr())
+		closeIgnore(conn)
+		return
+	}
+	defer t.connections.remove(info)
+	conn = &statsConn{conn, &info.uplink, &info.downlink, nil}
+	conn = &statsConn{conn, &t.tcpUplink, &t.tcpDownlink, nil}
+	if stats := t.labelStatsFor(source, destination, uid); stats != nil {
+		conn = &statsConn{conn, &stats.uplink, &stats.downlink, nil}
+	}
+
+	var app *appStats
+	if t.trafficStats && !isDns {
+		stats := t.appStatsFor(statsUid(uid, self))
 		atomic.AddInt32(&stats.tcpConn, 1)
 		atomic.AddUint32(&stats.tcpConnTotal, 1)
 		atomic.StoreInt64(&stats.deactivateAt, 0)
@@ -224,14 +406,48 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 				atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
 			}
 		}()
-		conn = &statsConn{conn, &stats.uplink, &stats.downlink}
+		conn = &statsConn{conn, &stats.uplink, &stats.downlink, stats.statusBytes(inbound)}
+		app = stats
+	}
+	conn = &firstByteConn{conn, info, app, t}
+	if t.debug {
+		conn = newImpairedConn(conn, t)
+	}
+
+	var domain string
+	if !isDns && sniffing {
+		ctx, conn, domain = t.sniffTCP(ctx, source, destination, conn)
+	}
+	if !t.allowConnection(source, destination, uid, domain) {
+		closeIgnore(conn)
+		return
+	}
+	if !isDns {
+		ctx = t.withUidTag(ctx, uid)
+	}
+
+	if dial := t.getDialOverride(); dial != nil {
+		releaseSetup()
+		relayOverride(ctx, dial, destination, conn)
+		closeIgnore(conn)
+		return
 	}
 
-	reader, input := pipe.New()
+	reader, input := t.newPipe()
 	link := &transport.Link{Reader: reader, Writer: connWriter{conn, buf.NewWriter(conn)}}
+	if lifetime := atomic.LoadInt32(&t.maxConnLifetime); lifetime > 0 {
+		timer := time.AfterFunc(time.Duration(lifetime)*time.Second, func() {
+			logrus.Debugf("[TCP] lifetime exceeded: %s ==> %s", source.NetAddr(), destination.NetAddr())
+			closeIgnore(conn, link.Reader, link.Writer)
+		})
+		defer timer.Stop()
+	}
+	outbound.set(t.v2ray.pickOutbound(ctx, destination, domain))
 	err := t.v2ray.dispatcher.DispatchLink(ctx, destination, link)
+	releaseSetup()
 	if err != nil {
 		logrus.Errorf("[TCP] dispatchLink failed: %s", err.Error())
+		t.reportError(destination, uid, err)
 	} else {
 		buf.Copy(buf.NewReader(conn), input)
 	}
@@ -239,19 +455,56 @@ func (t *Tun2ray) NewConnection(source v2rayNet.Destination, destination v2rayNe
 	closeIgnore(conn, link.Reader, link.Writer)
 }
 
+// SetMaxConnectionLifetime closes TCP connections older than the given seconds, 0 disables the cap.
+func (t *Tun2ray) SetMaxConnectionLifetime(seconds int32) {
+	atomic.StoreInt32(&t.maxConnLifetime, seconds)
+}
+
+// newPipe creates the pipe buffering a connection's uplink. With a pipe limit, writes block once
+// that many bytes are buffered, so a slow outbound pushes back on the app instead of using memory.
+func (t *Tun2ray) newPipe() (*pipe.Reader, *pipe.Writer) {
+	if t.pipeLimit > 0 {
+		return pipe.New(pipe.WithSizeLimit(t.pipeLimit))
+	}
+	return pipe.New()
+}
+
 type connWriter struct {
 	net.Conn
 	buf.Writer
 }
 
 func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.Destination, data []byte, writeBack func([]byte, *net.UDPAddr) (int, error), closer io.Closer) {
+	if !t.enterSession() {
+		closeIgnore(closer)
+		return
+	}
+	defer t.sessions.Done()
+
+	if t.isPaused() {
+		closeIgnore(closer)
+		return
+	}
+	if t.dropFamily(destination) {
+		closeIgnore(closer)
+		return
+	}
+	t.wake()
+	t.recordUDP(udpRecordUplink, source, destination, data)
+
 	natKey := source.NetAddr()
+	isDns := t.isRouter(destination)
 
-	sendTo := func() bool {
+	// sendTo forwards the datagram through an existing session. Queries to the DNS router are
+	// rate limited per datagram unless the session was just created by this one.
+	sendTo := func(limit bool) bool {
 		conn := t.udpTable.Get(natKey)
 		if conn == nil {
 			return false
 		}
+		if limit && isDns && !t.allowDNS(t.udpTable.Uid(natKey)) {
+			return true
+		}
 		_, err := conn.WriteTo(data, &net.UDPAddr{
 			IP:   destination.Address.IP(),
 			Port: int(destination.Port),
@@ -262,29 +515,38 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 		return true
 	}
 
-	if sendTo() {
+	if sendTo(true) {
 		return
 	}
 
+	t.udpTable.SweepLocks(staleLockAge)
+
 	lockKey := natKey + "-lock"
 	cond, loaded := t.udpTable.GetOrCreateLock(lockKey)
 	if loaded {
 		cond.L.Lock()
-		cond.Wait()
-		sendTo()
+		if t.udpTable.IsLock(lockKey, cond) {
+			cond.Wait()
+		}
+		sendTo(true)
 		cond.L.Unlock()
 		return
 	}
 
-	t.udpTable.Delete(lockKey)
-	cond.Broadcast()
+	defer func() {
+		if r := recover(); r != nil {
+			t.udpTable.ReleaseLock(lockKey, cond)
+			closeIgnore(closer)
+			logrus.Errorf("[UDP] session for %s panicked: %v", natKey, r)
+		}
+	}()
+
+	t.udpTable.ReleaseLock(lockKey, cond)
 
 	inbound := &session.Inbound{
 		Source: source,
 		Tag:    "socks",
 	}
-	isDns := destination.Address.String() == t.router
-
 	if isDns {
 		inbound.Tag = "dns-in"
 	}
@@ -294,7 +556,7 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 
 	if t.dumpUid || t.trafficStats {
 
-		u, err := uidDumper.DumpUid(source.Address.Family().IsIPv6(), true, source.Address.String(), int32(source.Port), destination.Address.String(), int32(destination.Port))
+		u, err := dumpUid(true, source, destination)
 		if err == nil {
 			uid = uint16(u)
 			var info *UidInfo
@@ -323,7 +585,7 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 			}
 
 			inbound.Uid = uint32(uid)
-			if uid == foregroundUid || uid == foregroundImeUid {
+			if isForeground(uid) {
 				inbound.AppStatus = append(inbound.AppStatus, appStatusForeground)
 			} else {
 				inbound.AppStatus = append(inbound.AppStatus, appStatusBackground)
@@ -333,18 +595,24 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 
 	}
 
+	if isDns && !t.allowDNS(uid) {
+		closeIgnore(closer)
+		return
+	}
+
 	ctx := session.ContextWithInbound(context.Background(), inbound)
 
-	if !isDns && (t.sniffing || t.fakedns) {
+	sniffing := t.sniffingFor(true)
+	if !isDns && (sniffing || t.fakedns) {
 		req := session.SniffingRequest{
 			Enabled:      true,
-			MetadataOnly: t.fakedns && !t.sniffing,
+			MetadataOnly: t.fakedns && !sniffing,
 			RouteOnly:    !t.overrideDestination,
 		}
 		if t.fakedns {
 			req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "fakedns")
 		}
-		if t.sniffing {
+		if sniffing {
 			req.OverrideDestinationForProtocol = append(req.OverrideDestinationForProtocol, "quic")
 		}
 		ctx = session.ContextWithContent(ctx, &session.Content{
@@ -352,25 +620,59 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 		})
 	}
 
+	var domain string
+	if !isDns && sniffing {
+		ctx, domain = t.sniffUDP(ctx, source, destination, data)
+	}
+	if !t.allowConnection(source, destination, uid, domain) {
+		closeIgnore(closer)
+		return
+	}
+	if !isDns {
+		ctx = t.withUidTag(ctx, uid)
+	}
+
+	if t.natFull(source, destination, uid) {
+		closeIgnore(closer)
+		return
+	}
+
+	outbound := &outboundTag{}
+	outbound.set(t.v2ray.pickOutbound(ctx, destination, domain))
+	ctx = t.withSourcePort(ctx, source, destination)
 	conn, err := t.v2ray.dialUDP(ctx, destination, time.Minute*5)
 	if err != nil {
 		logrus.Errorf("[UDP] dial failed: %s", err.Error())
+		t.reportError(destination, uid, err)
+		closeIgnore(closer)
 		return
 	}
 
-	if t.trafficStats && !self && !isDns {
-		t.access.RLock()
-		stats := t.appStats[uid]
-		t.access.RUnlock()
-		if stats == nil {
-			t.access.Lock()
-			stats = t.appStats[uid]
-			if stats == nil {
-				stats = &appStats{}
-				t.appStats[uid] = stats
-			}
-			t.access.Unlock()
-		}
+	info := &connInfo{
+		uid:         uid,
+		network:     "udp",
+		source:      source,
+		destination: destination,
+		startedAt:   time.Now().Unix(),
+		start:       time.Now(),
+		closer:      conn,
+		outbound:    outbound,
+	}
+	if !t.connections.add(info) {
+		logrus.Debugf("[UDP] destination limit reached: %s ==> %s", source.NetAddr(), destination.NetAddr())
+		closeIgnore(conn, closer)
+		return
+	}
+	defer t.connections.remove(info)
+	conn = &statsPacketConn{conn, &info.uplink, &info.downlink, nil}
+	conn = &statsPacketConn{conn, &t.udpUplink, &t.udpDownlink, nil}
+	if stats := t.labelStatsFor(source, destination, uid); stats != nil {
+		conn = &statsPacketConn{conn, &stats.uplink, &stats.downlink, nil}
+	}
+
+	var app *appStats
+	if t.trafficStats && !isDns {
+		stats := t.appStatsFor(statsUid(uid, self))
 		atomic.AddInt32(&stats.udpConn, 1)
 		atomic.AddUint32(&stats.udpConnTotal, 1)
 		atomic.StoreInt64(&stats.deactivateAt, 0)
@@ -379,74 +681,89 @@ func (t *Tun2ray) NewPacket(source v2rayNet.Destination, destination v2rayNet.De
 				atomic.StoreInt64(&stats.deactivateAt, time.Now().Unix())
 			}
 		}()
-		conn = &statsPacketConn{conn, &stats.uplink, &stats.downlink}
+		conn = &statsPacketConn{conn, &stats.uplink, &stats.downlink, stats.statusBytes(inbound)}
+		app = stats
+	}
+	if t.trafficStats && isDns && uid > 0 {
+		conn = dnsQueryConn{conn, &t.appStatsFor(statsUid(uid, self)).dnsQueries}
 	}
+	conn = firstBytePacketConn{conn, info, app, t}
 
-	t.udpTable.Set(natKey, conn)
+	t.udpTable.Set(natKey, conn, uid)
+	// deferred to also run when the session panics, a stale mapping would swallow later datagrams
+	defer func() {
+		closeIgnore(conn, closer)
+		t.udpTable.Delete(natKey)
+	}()
 
-	go sendTo()
+	go sendTo(false)
 
-	for {
-		buffer, addr, err := conn.readFrom()
-		if err != nil {
-			break
-		}
+	var line *delayLine
+	if t.debug {
+		line = newDelayLine()
+		defer line.close()
+	}
+	write := func(buffer []byte, addr net.Addr) error {
 		if isDns {
 			addr = nil
 		}
-		if addr, ok := addr.(*net.UDPAddr); ok {
-			_, err = writeBack(buffer, addr)
-		} else {
-			_, err = writeBack(buffer, nil)
-		}
-		if err != nil {
-			break
+		t.waitResume()
+		udpAddr, _ := addr.(*net.UDPAddr)
+		if t.debug {
+			if t.impairDrop() {
+				return nil
+			}
+			from := destination
+			if udpAddr != nil {
+				from = v2rayNet.DestinationFromAddr(udpAddr)
+			}
+			t.recordUDP(udpRecordDownlink, from, source, buffer)
+			return line.schedule(t.impairDelay(), func() error {
+				return t.writeDatagram(writeBack, buffer, udpAddr)
+			})
 		}
+		return t.writeDatagram(writeBack, buffer, udpAddr)
 	}
-	// close
-	closeIgnore(conn, closer)
-	t.udpTable.Delete(natKey)
-}
-
-func (t *Tun2ray) dialDNS(ctx context.Context, _, _ string) (conn net.Conn, err error) {
-	conn, err = t.v2ray.dialContext(session.ContextWithInbound(ctx, &session.Inbound{
-		Tag:         "dns-in",
-		SkipFakeDNS: true,
-	}), v2rayNet.Destination{
-		Network: v2rayNet.Network_UDP,
-		Address: v2rayNet.ParseAddress("1.0.0.1"),
-		Port:    53,
-	})
-	if err == nil {
-		conn = wrappedConn{conn}
+	if limit := atomic.LoadInt32(&t.udpHighWater); limit > 0 {
+		buffer := newBackBuffer(int(limit), atomic.LoadInt32(&t.udpDropPolicy) == UdpDropOldest, &info.dropped, write)
+		defer buffer.close()
+		write = buffer.write
 	}
-	return
-}
-
-type wrappedConn struct {
-	net.Conn
-}
 
-func (c wrappedConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, err = c.Conn.Read(p)
-	if err == nil {
-		addr = c.Conn.RemoteAddr()
+	read := readWithGrace(conn, atomic.LoadInt32(&t.udpReadErrorThreshold))
+	for {
+		buffer, addr, err := read()
+		if err != nil {
+			break
+		}
+		if write(buffer, addr) != nil {
+			break
+		}
 	}
-	return
 }
 
-func (c wrappedConn) WriteTo(p []byte, _ net.Addr) (n int, err error) {
-	return c.Conn.Write(p)
-}
+// staleLockAge is how long a session lock may be held before it is considered orphaned.
+const staleLockAge = 10 * time.Second
 
 type natTable struct {
 	mapping sync.Map
+	// uids holds the uid of the sessions in mapping.
+	uids sync.Map
+	// locks holds the creation time of the session locks in mapping.
+	locks sync.Map
 }
 
-func (t *natTable) Set(key string, pc net.PacketConn) {
+func (t *natTable) Set(key string, pc net.PacketConn, uid uint16) {
+	t.uids.Store(key, uid)
 	t.mapping.Store(key, pc)
 }
 
+func (t *natTable) Uid(key string) uint16 {
+	uid, _ := t.uids.Load(key)
+	u, _ := uid.(uint16)
+	return u
+}
+
 func (t *natTable) Get(key string) net.PacketConn {
 	item, exist := t.mapping.Load(key)
 	if !exist {
@@ -457,11 +774,58 @@ func (t *natTable) Get(key string) net.PacketConn {
 
 func (t *natTable) GetOrCreateLock(key string) (*sync.Cond, bool) {
 	item, loaded := t.mapping.LoadOrStore(key, sync.NewCond(&sync.Mutex{}))
+	if !loaded {
+		t.locks.Store(key, time.Now())
+	}
 	return item.(*sync.Cond), loaded
 }
 
+func (t *natTable) IsLock(key string, cond *sync.Cond) bool {
+	item, exist := t.mapping.Load(key)
+	return exist && item == cond
+}
+
+// ReleaseLock removes the lock and wakes up its waiters. It holds the lock's mutex so a waiter
+// either sees the lock removed or is already waiting.
+func (t *natTable) ReleaseLock(key string, cond *sync.Cond) {
+	cond.L.Lock()
+	if t.IsLock(key, cond) {
+		t.mapping.Delete(key)
+		t.locks.Delete(key)
+	}
+	cond.Broadcast()
+	cond.L.Unlock()
+}
+
+// SweepLocks releases the locks older than maxAge and returns how many were released.
+func (t *natTable) SweepLocks(maxAge time.Duration) int {
+	var swept int
+	t.locks.Range(func(key, value interface{}) bool {
+		if time.Since(value.(time.Time)) < maxAge {
+			return true
+		}
+		if item, exist := t.mapping.Load(key); exist {
+			if cond, ok := item.(*sync.Cond); ok {
+				t.ReleaseLock(key.(string), cond)
+				swept++
+				return true
+			}
+		}
+		t.locks.Delete(key)
+		return true
+	})
+	return swept
+}
+
 func (t *natTable) Delete(key string) {
 	t.mapping.Delete(key)
+	t.uids.Delete(key)
+}
+
+// SweepUdpLocks releases UDP session locks held longer than the given seconds, which only
+// happens if a session setup was interrupted, and returns how many were released.
+func (t *Tun2ray) SweepUdpLocks(seconds int32) int32 {
+	return int32(t.udpTable.SweepLocks(time.Duration(seconds) * time.Second))
 }
 
 var ipv6Mode int32
@@ -469,3 +833,37 @@ var ipv6Mode int32
 func SetIPv6Mode(mode int32) {
 	ipv6Mode = mode
 }
+
+func GetIPv6Mode() int32 {
+	return ipv6Mode
+}
+
+// dropFamily reports whether the destination family is disabled by ipv6Mode (IPv6 in
+// IPv4-only mode 0, IPv4 in IPv6-only mode 3) and counts the drop.
+func (t *Tun2ray) dropFamily(destination v2rayNet.Destination) bool {
+	var drop bool
+	switch ipv6Mode {
+	case 0:
+		drop = destination.Address.Family().IsIPv6()
+	case 3:
+		drop = destination.Address.Family().IsIPv4()
+	}
+	if drop {
+		atomic.AddUint64(&t.familyDropped, 1)
+	}
+	return drop
+}
+
+// GetFamilyDropped returns the number of connections and packets dropped for having a destination
+// of a family disabled by the IPv6 mode.
+func (t *Tun2ray) GetFamilyDropped() int64 {
+	return int64(atomic.LoadUint64(&t.familyDropped))
+}
+
+var ipv4Mapped bool
+
+// SetIPv4MappedMode makes the protected dialer reach IPv4 destinations through IPv6 sockets
+// with IPv4-mapped addresses when IPv6 is not disabled.
+func SetIPv4MappedMode(mapped bool) {
+	ipv4Mapped = mapped
+}
@@ -0,0 +1,50 @@
+package libcore
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/v2fly/v2ray-core/v4/common/buf"
+)
+
+func TestPipeLimitBackpressure(t *testing.T) {
+	tun := &Tun2ray{pipeLimit: 8 * 1024}
+	reader, writer := tun.newPipe()
+	defer writer.Close()
+
+	const writes = 32
+	var written int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < writes; i++ {
+			b := buf.New()
+			b.Extend(2048)
+			if writer.WriteMultiBuffer(buf.MultiBuffer{b}) != nil {
+				return
+			}
+			atomic.AddInt32(&written, 1)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&written); n >= writes || int(n)*2048 > 8*1024+2048 {
+		t.Fatalf("writer not blocked by the limit: %d writes buffered", n)
+	}
+
+	var read int
+	for read < writes*2048 {
+		mb, err := reader.ReadMultiBuffer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		read += int(mb.Len())
+		buf.ReleaseMulti(mb)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer still blocked after the reader drained the pipe")
+	}
+}
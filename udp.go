@@ -0,0 +1,181 @@
+package libcore
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SetUdpReadErrorThreshold sets how many consecutive read errors a UDP session survives before
+// it is closed, the default of 1 closes it on the first error. A closed connection always ends
+// the session at once.
+func (t *Tun2ray) SetUdpReadErrorThreshold(threshold int32) {
+	atomic.StoreInt32(&t.udpReadErrorThreshold, threshold)
+}
+
+// udpReadBackoff is the wait before retrying a failed read, doubled on each consecutive error up
+// to udpReadMaxBackoff.
+const (
+	udpReadBackoff    = 10 * time.Millisecond
+	udpReadMaxBackoff = time.Second
+)
+
+func readWithGrace(conn packetConn, threshold int32) func() ([]byte, net.Addr, error) {
+	var readErrors int32
+	return func() (buffer []byte, addr net.Addr, err error) {
+		backoff := udpReadBackoff
+		for {
+			buffer, addr, err = conn.readFrom()
+			if err == nil {
+				readErrors = 0
+				return
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			readErrors++
+			if readErrors >= threshold {
+				return
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > udpReadMaxBackoff {
+				backoff = udpReadMaxBackoff
+			}
+		}
+	}
+}
+
+// writeDatagram writes a datagram back to the app. Neither stack can send the rest of a datagram
+// separately, so a short write is counted and logged as a truncation instead of retried.
+func (t *Tun2ray) writeDatagram(writeBack func([]byte, *net.UDPAddr) (int, error), buffer []byte, addr *net.UDPAddr) error {
+	n, err := writeBack(buffer, addr)
+	if err == nil && n < len(buffer) {
+		atomic.AddUint64(&t.udpTruncated, 1)
+		logrus.Debugf("[udp] datagram truncated: wrote %d of %d bytes", n, len(buffer))
+	}
+	return err
+}
+
+// GetUdpTruncated returns the number of datagrams the stack accepted only partially.
+func (t *Tun2ray) GetUdpTruncated() int64 {
+	return int64(atomic.LoadUint64(&t.udpTruncated))
+}
+
+// Which datagram a UDP session drops when its write-back buffer is over the high-water mark.
+const (
+	UdpDropNewest int32 = iota
+	UdpDropOldest
+)
+
+// SetUdpHighWater bounds the bytes a UDP session may hold waiting to be written back to the app,
+// over the limit a datagram is dropped according to the policy and counted on the session.
+// 0 writes back without a buffer. Datagrams larger than the limit are always dropped.
+func (t *Tun2ray) SetUdpHighWater(bytes int32, policy int32) {
+	atomic.StoreInt32(&t.udpDropPolicy, policy)
+	atomic.StoreInt32(&t.udpHighWater, bytes)
+}
+
+// backBuffer decouples reading a UDP session from writing it back to the app, holding at most
+// limit bytes including the datagram being written.
+type backBuffer struct {
+	access     sync.Mutex
+	ready      *sync.Cond
+	queue      []*udpPacket
+	size       int
+	limit      int
+	dropOldest bool
+	dropped    *uint64
+	closed     bool
+	err        error
+	exited     chan struct{}
+}
+
+func newBackBuffer(limit int, dropOldest bool, dropped *uint64, write func([]byte, net.Addr) error) *backBuffer {
+	b := &backBuffer{
+		limit:      limit,
+		dropOldest: dropOldest,
+		dropped:    dropped,
+		exited:     make(chan struct{}),
+	}
+	b.ready = sync.NewCond(&b.access)
+	go b.loop(write)
+	return b
+}
+
+// write queues the datagram and returns the error of a failed write back.
+func (b *backBuffer) write(buffer []byte, addr net.Addr) error {
+	b.access.Lock()
+	defer b.access.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+	if b.closed {
+		return io.ErrClosedPipe
+	}
+	for b.size+len(buffer) > b.limit {
+		atomic.AddUint64(b.dropped, 1)
+		if !b.dropOldest || len(b.queue) == 0 {
+			return nil
+		}
+		b.size -= len(b.queue[0].buffer)
+		b.queue[0] = nil
+		b.queue = b.queue[1:]
+	}
+	b.queue = append(b.queue, &udpPacket{buffer, addr})
+	b.size += len(buffer)
+	b.ready.Signal()
+	return nil
+}
+
+func (b *backBuffer) loop(write func([]byte, net.Addr) error) {
+	defer close(b.exited)
+	b.access.Lock()
+	defer b.access.Unlock()
+
+	for {
+		for len(b.queue) == 0 && !b.closed {
+			b.ready.Wait()
+		}
+		if len(b.queue) == 0 {
+			return
+		}
+		packet := b.queue[0]
+		b.queue[0] = nil
+		b.queue = b.queue[1:]
+
+		b.access.Unlock()
+		err := write(packet.buffer, packet.addr)
+		b.access.Lock()
+
+		b.size -= len(packet.buffer)
+		if err != nil {
+			b.err = err
+			b.queue = nil
+			b.size = 0
+			return
+		}
+	}
+}
+
+// close discards the queued datagrams and waits for the datagram being written, so nothing is
+// written back after the session returns.
+func (b *backBuffer) close() {
+	b.access.Lock()
+	b.closed = true
+	b.queue = nil
+	b.size = 0
+	b.ready.Signal()
+	b.access.Unlock()
+	<-b.exited
+}
+
+type udpPacket struct {
+	buffer []byte
+	addr   net.Addr
+}
@@ -0,0 +1,86 @@
+package libcore
+
+import (
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestWriteDatagramShortWrite(t *testing.T) {
+	tun := &Tun2ray{}
+	datagram := make([]byte, 65000)
+	var written int
+	shortWrite := func(buffer []byte, _ *net.UDPAddr) (int, error) {
+		written = len(buffer)
+		return 1500, nil
+	}
+
+	if err := tun.writeDatagram(shortWrite, datagram, nil); err != nil {
+		t.Fatal(err)
+	}
+	if written != len(datagram) {
+		t.Fatalf("datagram split: write back got %d of %d bytes", written, len(datagram))
+	}
+	if n := tun.GetUdpTruncated(); n != 1 {
+		t.Fatalf("truncations: want 1, got %d", n)
+	}
+
+	fullWrite := func(buffer []byte, _ *net.UDPAddr) (int, error) {
+		return len(buffer), nil
+	}
+	if err := tun.writeDatagram(fullWrite, datagram, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := tun.GetUdpTruncated(); n != 1 {
+		t.Fatalf("full write counted as truncation: %d", n)
+	}
+}
+
+func TestBackBufferDropPolicy(t *testing.T) {
+	for _, dropOldest := range []bool{false, true} {
+		block := make(chan struct{})
+		written := make(chan byte, 8)
+		write := func(buffer []byte, _ net.Addr) error {
+			<-block
+			written <- buffer[0]
+			return nil
+		}
+
+		var dropped uint64
+		b := newBackBuffer(3, dropOldest, &dropped, write)
+		for i := byte(1); i <= 5; i++ {
+			if err := b.write([]byte{i}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if i == 1 {
+				// wait for the writer to hold the first datagram
+				for {
+					b.access.Lock()
+					held := len(b.queue) == 0
+					b.access.Unlock()
+					if held {
+						break
+					}
+					runtime.Gosched()
+				}
+			}
+		}
+		close(block)
+
+		var got []byte
+		for i := 0; i < 3; i++ {
+			got = append(got, <-written)
+		}
+		b.close()
+		want := []byte{1, 2, 3}
+		if dropOldest {
+			want = []byte{1, 4, 5}
+		}
+		if string(got) != string(want) {
+			t.Fatalf("dropOldest=%v: want %v, got %v", dropOldest, want, got)
+		}
+		if dropped != 2 {
+			t.Fatalf("dropOldest=%v: want 2 drops, got %d", dropOldest, dropped)
+		}
+	}
+}
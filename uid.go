@@ -1,5 +1,13 @@
 package libcore
 
+import (
+	"context"
+	"sync/atomic"
+
+	v2rayNet "github.com/v2fly/v2ray-core/v4/common/net"
+	"github.com/v2fly/v2ray-core/v4/common/session"
+)
+
 var uidDumper UidDumper
 
 type UidInfo struct {
@@ -16,14 +24,91 @@ func SetUidDumper(dumper UidDumper) {
 	uidDumper = dumper
 }
 
-var foregroundUid uint16
+// dumpUid looks up the uid owning the flow. The app socket is IPv6 if either end is, since an
+// IPv4 socket can't reach the other family. If that fails the other family is tried, for flows
+// whose addresses were rewritten by FakeDNS or NAT64.
+func dumpUid(udp bool, source v2rayNet.Destination, destination v2rayNet.Destination) (int32, error) {
+	ipv6 := source.Address.Family().IsIPv6() || destination.Address.Family().IsIPv6()
+	srcIp, destIp := source.Address.IP().String(), destination.Address.IP().String()
+	uid, err := uidDumper.DumpUid(ipv6, udp, srcIp, int32(source.Port), destIp, int32(destination.Port))
+	if err != nil {
+		uid, err = uidDumper.DumpUid(!ipv6, udp, srcIp, int32(source.Port), destIp, int32(destination.Port))
+	}
+	return uid, err
+}
 
+var foregroundUid int32
+
+// SetForegroundUid sets the uid of the app in the foreground. Connections opened by it or by the
+// foreground input method afterwards carry the "foreground" app status, which routing rules can
+// match, all others carry "background". Connections already open keep their status. The uid is
+// only known with uid dumping or traffic stats enabled.
 func SetForegroundUid(uid int32) {
-	foregroundUid = uint16(uid)
+	atomic.StoreInt32(&foregroundUid, int32(uint16(uid)))
 }
 
-var foregroundImeUid uint16
+var foregroundImeUid int32
 
+// SetForegroundImeUid sets the uid of the input method shown over the foreground app, which is
+// treated as foreground too, see SetForegroundUid.
 func SetForegroundImeUid(uid int32) {
-	foregroundImeUid = uint16(uid)
+	atomic.StoreInt32(&foregroundImeUid, int32(uint16(uid)))
+}
+
+func isForeground(uid uint16) bool {
+	return int32(uid) == atomic.LoadInt32(&foregroundUid) || int32(uid) == atomic.LoadInt32(&foregroundImeUid)
+}
+
+type ForegroundApp struct {
+	Uid         int32
+	PackageName string
+	Label       string
+}
+
+// foregroundApp caches the info of the last foreground uid looked up.
+var foregroundApp atomic.Value
+
+// GetForegroundApp returns the current foreground uid with its package and label, which are empty
+// if no uid dumper is set or the lookup fails. Successful lookups are cached per foreground uid.
+func GetForegroundApp() *ForegroundApp {
+	uid := atomic.LoadInt32(&foregroundUid)
+	if app, ok := foregroundApp.Load().(*ForegroundApp); ok && app.Uid == uid {
+		return app
+	}
+	app := &ForegroundApp{Uid: uid}
+	if dumper := uidDumper; dumper != nil && uid > 0 {
+		if info, err := dumper.GetUidInfo(uid); err == nil && info != nil {
+			app.PackageName = info.PackageName
+			app.Label = info.Label
+			foregroundApp.Store(app)
+		}
+	}
+	return app
+}
+
+// SetUidTag routes all traffic of the app except DNS to the outbound tag, bypassing the routing
+// rules. An empty tag restores the default routing. The uid is only known with uid dumping or
+// traffic stats enabled.
+func (t *Tun2ray) SetUidTag(uid int32, tag string) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	if tag == "" {
+		delete(t.uidTags, uint16(uid))
+		return
+	}
+	if t.uidTags == nil {
+		t.uidTags = map[uint16]string{}
+	}
+	t.uidTags[uint16(uid)] = tag
+}
+
+func (t *Tun2ray) withUidTag(ctx context.Context, uid uint16) context.Context {
+	t.access.RLock()
+	tag := t.uidTags[uid]
+	t.access.RUnlock()
+	if tag == "" {
+		return ctx
+	}
+	return session.SetForcedOutboundTagToContext(ctx, tag)
 }
@@ -18,6 +18,7 @@ import (
 	"github.com/v2fly/v2ray-core/v4/features"
 	"github.com/v2fly/v2ray-core/v4/features/dns"
 	"github.com/v2fly/v2ray-core/v4/features/extension"
+	"github.com/v2fly/v2ray-core/v4/features/outbound"
 	"github.com/v2fly/v2ray-core/v4/features/routing"
 	"github.com/v2fly/v2ray-core/v4/features/stats"
 	"github.com/v2fly/v2ray-core/v4/infra/conf/serial"
@@ -37,6 +38,9 @@ type V2RayInstance struct {
 	observatory  features.TaggedFeatures
 	dispatcher   routing.Dispatcher
 	dnsClient    dns.Client
+
+	router          routing.Router
+	outboundManager outbound.Manager
 }
 
 func NewV2rayInstance() *V2RayInstance {
@@ -72,6 +76,10 @@ func (instance *V2RayInstance) LoadConfig(content string) error {
 	instance.statsManager = c.GetFeature(stats.ManagerType()).(stats.Manager)
 	instance.dispatcher = c.GetFeature(routing.DispatcherType()).(routing.Dispatcher)
 	instance.dnsClient = c.GetFeature(dns.ClientType()).(dns.Client)
+	instance.outboundManager = c.GetFeature(outbound.ManagerType()).(outbound.Manager)
+	if router, ok := c.GetFeature(routing.RouterType()).(routing.Router); ok {
+		instance.router = router
+	}
 
 	o := c.GetFeature(extension.ObservatoryType())
 	if o != nil {
@@ -97,6 +105,22 @@ func (instance *V2RayInstance) Start() error {
 	return nil
 }
 
+// ready returns an error unless the instance is started and has the features the tun relies on.
+func (instance *V2RayInstance) ready() error {
+	if instance == nil {
+		return errors.New("v2ray instance is nil")
+	}
+	instance.access.Lock()
+	defer instance.access.Unlock()
+	if !instance.started || instance.core == nil {
+		return errors.New("v2ray instance not started")
+	}
+	if instance.dispatcher == nil || instance.dnsClient == nil {
+		return errors.New("v2ray instance missing dispatcher or dns client")
+	}
+	return nil
+}
+
 func (instance *V2RayInstance) QueryStats(tag string, direct string) int64 {
 	if instance.statsManager == nil {
 		return 0
@@ -112,6 +136,7 @@ func (instance *V2RayInstance) Close() error {
 	instance.access.Lock()
 	defer instance.access.Unlock()
 	if instance.started {
+		instance.started = false
 		return instance.core.Close()
 	}
 	return nil
@@ -205,7 +230,10 @@ func (c *dispatcherConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	select {
 	case <-c.ctx.Done():
 		return 0, nil, io.EOF
-	case packet := <-c.cache:
+	case packet, ok := <-c.cache:
+		if !ok {
+			return 0, nil, io.EOF
+		}
 		n := copy(p, packet.Payload.Bytes())
 		return n, &net.UDPAddr{
 			IP:   packet.Source.Address.IP(),
@@ -218,7 +246,10 @@ func (c *dispatcherConn) readFrom() (p []byte, addr net.Addr, err error) {
 	select {
 	case <-c.ctx.Done():
 		return nil, nil, io.EOF
-	case packet := <-c.cache:
+	case packet, ok := <-c.cache:
+		if !ok {
+			return nil, nil, io.EOF
+		}
 		return packet.Payload.Bytes(), &net.UDPAddr{
 			IP:   packet.Source.Address.IP(),
 			Port: int(packet.Source.Port),
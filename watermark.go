@@ -0,0 +1,67 @@
+package libcore
+
+// ResourceListener is notified when the active connections ("tcp") or UDP sessions ("udp") exceed
+// their high watermark, and again when they recede below the low one.
+type ResourceListener interface {
+	OnHighWater(network string, count int32)
+	OnLowWater(network string, count int32)
+}
+
+type watermark struct {
+	high  int32
+	low   int32
+	count int32
+	above bool
+}
+
+// SetResourceWatermarks sets the watermarks of active connections and UDP sessions. A high
+// watermark of 0 disables notifications for that network.
+func (t *Tun2ray) SetResourceWatermarks(connHigh int32, connLow int32, udpHigh int32, udpLow int32, listener ResourceListener) {
+	t.connections.setWatermarks(connHigh, connLow, udpHigh, udpLow, listener)
+}
+
+func (t *connTable) setWatermarks(connHigh int32, connLow int32, udpHigh int32, udpLow int32, listener ResourceListener) {
+	t.access.Lock()
+	defer t.access.Unlock()
+
+	t.tcp.set(connHigh, connLow)
+	t.udp.set(udpHigh, udpLow)
+	t.resourceListener = listener
+}
+
+func (w *watermark) set(high int32, low int32) {
+	if low > high {
+		low = high
+	}
+	w.high = high
+	w.low = low
+	w.above = false
+}
+
+// count applies delta to the session count of the network and returns the notification to send
+// once the table is unlocked, or nil. Must be called with the table locked.
+func (t *connTable) count(network string, delta int32) func() {
+	w := &t.tcp
+	if network == "udp" {
+		w = &t.udp
+	}
+	w.count += delta
+	listener := t.resourceListener
+	if listener == nil || w.high <= 0 {
+		return nil
+	}
+	count := w.count
+	if !w.above && count > w.high {
+		w.above = true
+		return func() {
+			listener.OnHighWater(network, count)
+		}
+	}
+	if w.above && count < w.low {
+		w.above = false
+		return func() {
+			listener.OnLowWater(network, count)
+		}
+	}
+	return nil
+}